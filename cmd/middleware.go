@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,6 +27,7 @@ func (s *Server) AuthMiddleware() gin.HandlerFunc {
 				"error":  "Bad Authentication",
 			})
 			c.Abort()
+			return
 		}
 
 		ses, err := s.userService.GetSessionByID(sesToken)
@@ -39,6 +45,115 @@ func (s *Server) AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// streamTokenTTL is how long a stream token can open event streams.
+const streamTokenTTL = time.Minute
+
+type streamToken struct {
+	userId  string
+	expires time.Time
+}
+
+// streamTokens are short lived tokens that only open event streams. EventSource
+// can't set headers, so they are passed as a query parameter and end up in
+// access logs, where the session token must not.
+type streamTokens struct {
+	mu     sync.Mutex
+	tokens map[string]streamToken
+}
+
+func newStreamTokens() *streamTokens {
+	return &streamTokens{tokens: make(map[string]streamToken)}
+}
+
+func (t *streamTokens) issue(userId string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for key, existing := range t.tokens {
+		if now.After(existing.expires) {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[token] = streamToken{userId: userId, expires: now.Add(streamTokenTTL)}
+
+	return token, nil
+}
+
+func (t *streamTokens) user(token string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	existing, ok := t.tokens[token]
+	if !ok || time.Now().After(existing.expires) {
+		return "", false
+	}
+	return existing.userId, true
+}
+
+// StreamAuthMiddleware authenticates event streams with the Authorization
+// header or a stream token from PostStreamToken in the token query parameter.
+func (s *Server) StreamAuthMiddleware() gin.HandlerFunc {
+	auth := s.AuthMiddleware()
+
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			auth(c)
+			return
+		}
+
+		userId, ok := s.streamTokens.user(c.Query("token"))
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "failiure",
+				"error":  "Bad Authentication",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("session", userId)
+		c.Next()
+	}
+}
+
+// PostStreamToken hands out a stream token for the user of the session.
+func (s *Server) PostStreamToken(c *gin.Context) {
+	token, err := s.streamTokens.issue(c.GetString("session"))
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"token":      token,
+		"expires_in": int(streamTokenTTL.Seconds()),
+	})
+}
+
+// userOwnsDeployment reports whether the deployment belongs to the user of the
+// session set by AuthMiddleware.
+func (s *Server) userOwnsDeployment(c *gin.Context, deploymentId string) bool {
+	userId := c.GetString("session")
+	if userId == "" {
+		return false
+	}
+
+	_, err := s.userService.GetUserDeployment(userId, deploymentId)
+	return err == nil
+}
+
 func corsMiddleware() gin.HandlerFunc {
 	originsString := "http://localhost:3000,,http://orchestration.dakshsangal.live,https://orchestration.dakshsangal.live"
 	var allowedOrigins []string
@@ -11,15 +11,22 @@ type WebhookPayloadCommitStruct struct {
 	CommitMessage string                           `json:"message"`
 	CommitUrl     string                           `json:"url"`
 	Author        WebhookPayloadCommitAuthorStruct `json:"author"`
+	Added         []string                         `json:"added"`
+	Modified      []string                         `json:"modified"`
+	Removed       []string                         `json:"removed"`
 }
 type WebhookPayloadRepositoryStruct struct {
-	Name     string `json:"full_name"`
-	Url      string `json:"url"`
-	CloneUrl string `json:"clone_url"`
+	Name          string `json:"full_name"`
+	Url           string `json:"url"`
+	CloneUrl      string `json:"clone_url"`
+	SshUrl        string `json:"ssh_url"`
+	DefaultBranch string `json:"default_branch"`
 }
 
 type WebhookPayloadStruct struct {
 	Ref        string                         `json:"ref"`
+	After      string                         `json:"after"`
+	Deleted    bool                           `json:"deleted"`
 	Repository WebhookPayloadRepositoryStruct `json:"repository"`
 	Commits    []WebhookPayloadCommitStruct   `json:"commits"`
 }
@@ -27,3 +34,106 @@ type WebhookPayloadStruct struct {
 type WebhookPayloadBody struct {
 	Payload WebhookPayloadStruct `json:"payload"`
 }
+
+type GitlabPayloadCommitStruct struct {
+	CommitHash string   `json:"id"`
+	Added      []string `json:"added"`
+	Modified   []string `json:"modified"`
+	Removed    []string `json:"removed"`
+}
+
+type GitlabPayloadProjectStruct struct {
+	Name          string `json:"path_with_namespace"`
+	HttpUrl       string `json:"git_http_url"`
+	SshUrl        string `json:"git_ssh_url"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+type GitlabPayloadStruct struct {
+	Ref     string                      `json:"ref"`
+	After   string                      `json:"after"`
+	Project GitlabPayloadProjectStruct  `json:"project"`
+	Commits []GitlabPayloadCommitStruct `json:"commits"`
+}
+
+type BitbucketPayloadRefStruct struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+type BitbucketPayloadChangeStruct struct {
+	New    *BitbucketPayloadRefStruct `json:"new"`
+	Closed bool                       `json:"closed"`
+}
+
+type BitbucketPayloadRepositoryStruct struct {
+	Name       string `json:"full_name"`
+	MainBranch struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+}
+
+type BitbucketPayloadStruct struct {
+	Push struct {
+		Changes []BitbucketPayloadChangeStruct `json:"changes"`
+	} `json:"push"`
+	Repository BitbucketPayloadRepositoryStruct `json:"repository"`
+}
+
+type WebhookPullRequestRefStruct struct {
+	Ref  string `json:"ref"`
+	Sha  string `json:"sha"`
+	Repo struct {
+		Name string `json:"full_name"`
+	} `json:"repo"`
+}
+
+type WebhookPullRequestStruct struct {
+	Head WebhookPullRequestRefStruct `json:"head"`
+	Base WebhookPullRequestRefStruct `json:"base"`
+}
+
+// WebhookPullRequestPayloadStruct is the pull_request event of GitHub, Gitea
+// and Forgejo.
+type WebhookPullRequestPayloadStruct struct {
+	Action      string                   `json:"action"`
+	Number      int                      `json:"number"`
+	PullRequest WebhookPullRequestStruct `json:"pull_request"`
+}
+
+type GitlabMergeRequestPayloadStruct struct {
+	ObjectAttributes struct {
+		IID             int    `json:"iid"`
+		Action          string `json:"action"`
+		TargetBranch    string `json:"target_branch"`
+		OldRev          string `json:"oldrev"`
+		SourceProjectID int    `json:"source_project_id"`
+		TargetProjectID int    `json:"target_project_id"`
+		LastCommit      struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+type BitbucketPullRequestEndStruct struct {
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Commit struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Repository struct {
+		Name string `json:"full_name"`
+	} `json:"repository"`
+}
+
+type BitbucketPullRequestPayloadStruct struct {
+	PullRequest struct {
+		ID          int                           `json:"id"`
+		Source      BitbucketPullRequestEndStruct `json:"source"`
+		Destination BitbucketPullRequestEndStruct `json:"destination"`
+	} `json:"pullrequest"`
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/Qu-Ack/orchestration/services/deploy"
 	"github.com/Qu-Ack/orchestration/services/user"
@@ -11,59 +17,429 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// maxWebhookBodySize limits the body of webhook requests, pushes with many
+// commits stay well below it.
+const maxWebhookBodySize = 1 << 20
+
+// PostWebHook redeploys the deployments of the pushed repository whose branch
+// matches a pushed one. The git host is taken from the path or detected from
+// the headers, and requests have to be signed with the webhook secret of the
+// deployment they are meant for. Every request is stored as a delivery.
 func (s *Server) PostWebHook(c *gin.Context) {
+	provider, providerName, ok := webhookProvider(c.Param("provider"), c.Request.Header)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown webhook provider"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodySize)
+	body, err := c.GetRawData()
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body too large"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
 
-	c.JSON(http.StatusAccepted, gin.H{"message": "accepted"})
+	received := deploy.WebhookDelivery{
+		Provider:   providerName,
+		Headers:    c.Request.Header.Clone(),
+		Body:       string(body),
+		ReceivedAt: time.Now(),
+	}
 
-	var json WebhookPayloadStruct
+	push, isPush, err := parseWebhook(provider, c.Request.Header, body)
 
-	if err := c.ShouldBindJSON(&json); err != nil {
+	if err != nil {
+		s.recordDelivery(received, "", false, deploy.DeliveryInvalid, err.Error())
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	githubEvent := c.Request.Header.Get("x-github-event")
-	fmt.Println(githubEvent)
-	fmt.Println(json)
-
-	go func() {
-		if githubEvent == "push" {
-			exists := s.deployService.CheckDeploymentExistenceBasedOnCloneUrl(json.Repository.CloneUrl)
-			if exists {
-				dep, err := s.deployService.GetDeploymentBasedOnCloneUrl(json.Repository.CloneUrl)
-				if err != nil {
-					fmt.Printf("Error fetching deployment: %v\n", err)
-					return
-				}
-				s.deployService.DSM_SetDeploying(dep.ID)
-				go s.deployService.Deploy(dep, s.dockerCli, true, s.sseChannel, s.errorChannel)
-
-				c.JSON(http.StatusOK, gin.H{
-					"status": "ok",
-				})
-			} else {
-				//				deployment, err := s.deployService.NewDeploymentFromWebhook(json.Repository.Name, json.Repository.CloneUrl, json.Ref)
-				//				if err != nil {
-				//					fmt.Printf("Error creating new deployment: %v\n", err)
-				//					return
-				//				}
-
-				//				if err := s.deployService.Deploy(deployment, s.dockerCli, true); err != nil {
-				//					fmt.Printf("Error deploying new deployment: %v\n", err)
-				//					return
-				//				}
-
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": "no deployment found",
-				})
+	deps, err := s.deployService.GetDeploymentsBasedOnCloneUrls(push.CloneUrls)
+
+	// previews are driven by the pull requests of their parent.
+	deps = slices.DeleteFunc(deps, func(dep *deploy.Deployment) bool {
+		return dep.ParentID != ""
+	})
+
+	if err != nil || len(deps) == 0 {
+		log.Printf("{SERVER}: no deployment for webhook of %v: %v\n", push.CloneUrls, err)
+		s.recordDelivery(received, "", false, deploy.DeliveryInvalid, "no deployment found")
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no deployment found",
+		})
+		return
+	}
+
+	// a repository can have several deployments, each with its own secret,
+	// so only the ones that verify the request are considered.
+	verified := make([]*deploy.Deployment, 0)
+	for _, dep := range deps {
+		err = provider.Verify(s.deployService, dep, c.Request.Header, body)
+		if err != nil {
+			continue
+		}
+		verified = append(verified, dep)
+	}
+
+	if len(verified) == 0 {
+		log.Printf("{SERVER}: rejected webhook for %v: %v\n", push.CloneUrls, err)
+		for _, dep := range deps {
+			s.recordDelivery(received, dep.ID, false, deploy.DeliveryRejected, err.Error())
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	queued := make([]gin.H, 0)
+	for _, dep := range verified {
+		delivery := received
+		delivery.SignatureValid = true
+
+		deliveryId, position, ok := s.deliverWebhook(&delivery, push, isPush, dep)
+		if !ok {
+			continue
+		}
+
+		queued = append(queued, gin.H{
+			"deployment_id":  dep.ID,
+			"delivery_id":    deliveryId,
+			"queue_position": position,
+		})
+	}
+
+	if len(queued) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ignored",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":      "accepted",
+		"deployments": queued,
+	})
+}
+
+// recordDelivery stores a webhook request that didn't get as far as a deploy.
+// Anyone can send those, so their body is left out.
+func (s *Server) recordDelivery(delivery deploy.WebhookDelivery, deploymentId string, signatureValid bool, status deploy.DeliveryStatus, reason string) {
+	delivery.Body = ""
+	delivery.DeploymentID = deploymentId
+	delivery.SignatureValid = signatureValid
+	delivery.Status = status
+	delivery.Error = reason
+
+	err := s.deployService.RecordWebhookDelivery(&delivery)
+	if err != nil {
+		log.Printf("{SERVER}: failed to record webhook delivery: %v\n", err)
+	}
+}
+
+// deliverWebhook queues a deploy of the deployment for the last pushed branch
+// it follows, or of the preview for a pull request, and records the delivery.
+// It returns the delivery id and the place in the queue, or false if nothing
+// was queued.
+func (s *Server) deliverWebhook(delivery *deploy.WebhookDelivery, push *PushEvent, isPush bool, dep *deploy.Deployment) (string, int, bool) {
+	if push.PullRequest != nil {
+		return s.deliverPullRequest(delivery, push, dep)
+	}
+
+	var job *deploy.DeployJob
+
+	for _, branch := range push.Branches {
+		if !isPush || branch.Deleted {
+			continue
+		}
+		if !s.deployService.MatchBranch(dep, branch.Branch, push.DefaultBranch) {
+			continue
+		}
+		// pushes without a list of commits, e.g. from Bitbucket, always deploy.
+		if len(branch.Commits) > 0 && !s.deployService.TouchesRootDir(dep, branch.changedPaths()) {
+			delivery.Error = "no changes under " + dep.RootDir
+			continue
+		}
+
+		delivery.Error = ""
+		job = &deploy.DeployJob{
+			Deployment: dep,
+			Redeploy:   true,
+			Trigger:    deploy.TriggerWebhook,
+			Checkout: deploy.Checkout{
+				Branch:    branch.Branch,
+				CommitSHA: branch.CommitSHA,
+			},
+		}
+	}
+
+	delivery.DeploymentID = dep.ID
+	delivery.Status = deploy.DeliveryQueued
+	if job == nil {
+		delivery.Status = deploy.DeliveryIgnored
+	}
+
+	// the delivery is stored before the job is queued, so the worker finds
+	// it when linking the release.
+	err := s.deployService.RecordWebhookDelivery(delivery)
+	if err != nil {
+		log.Printf("{SERVER}: failed to record webhook delivery: %v\n", err)
+	}
+
+	if job == nil {
+		return delivery.ID, 0, false
+	}
+
+	if err == nil {
+		job.DeliveryIDs = []string{delivery.ID}
+	}
+
+	owner, err := s.userService.GetDeploymentOwner(dep.ID)
+	if err != nil {
+		log.Printf("{SERVER}: failed to fetch deployment owner: %v\n", err)
+	}
+	job.Owner = owner
+
+	return delivery.ID, s.deployService.EnqueueDeploy(job), true
+}
+
+// deliverPullRequest deploys the preview of a pull request against the
+// deployment's branch, creating it on the first event, and removes it once
+// the pull request is closed.
+func (s *Server) deliverPullRequest(delivery *deploy.WebhookDelivery, push *PushEvent, parent *deploy.Deployment) (string, int, bool) {
+	pr := push.PullRequest
+
+	delivery.DeploymentID = parent.ID
+	delivery.Status = deploy.DeliveryIgnored
+
+	var preview *deploy.Deployment
+	var err error
+
+	if pr.Action != PullRequestIgnored && s.deployService.MatchBranch(parent, pr.BaseBranch, push.DefaultBranch) {
+		preview, err = s.deployService.GetPreviewDeployment(parent, pr.Number)
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+	}
+
+	owner, ownerErr := s.userService.GetDeploymentOwner(parent.ID)
+	if ownerErr != nil {
+		log.Printf("{SERVER}: failed to fetch deployment owner: %v\n", ownerErr)
+	}
+
+	switch {
+	case err != nil:
+		// the delivery is stored as ignored along with the error.
+	case pr.Action == PullRequestClosed && preview != nil:
+		delivery.Status = deploy.DeliveryTeardown
+		go func() {
+			err := s.deployService.DeletePreviewDeployment(preview, s.dockerCli)
+			if err != nil {
+				log.Printf("{SERVER}: failed to remove preview deployment %s: %v\n", preview.ID, err)
 			}
+		}()
+	case pr.Action == PullRequestUpdated && pr.Fork:
+		delivery.Error = "pull requests from forks aren't deployed"
+	case pr.Action == PullRequestUpdated && preview == nil:
+		preview, err = s.deployService.NewPreviewDeployment(parent, pr.Number, pr.Ref)
+		if err != nil {
+			delivery.Error = err.Error()
+			break
 		}
-	}()
+
+		_, err = s.userService.AddDeploymentToUser(&user.UserDeployment{
+			UserID:       owner,
+			DeploymentID: preview.ID,
+		})
+		if err != nil {
+			delivery.Error = err.Error()
+			break
+		}
+
+		delivery.Status = deploy.DeliveryQueued
+	case pr.Action == PullRequestUpdated:
+		delivery.Status = deploy.DeliveryQueued
+	}
+
+	recordErr := s.deployService.RecordWebhookDelivery(delivery)
+	if recordErr != nil {
+		log.Printf("{SERVER}: failed to record webhook delivery: %v\n", recordErr)
+	}
+
+	if delivery.Status != deploy.DeliveryQueued {
+		return delivery.ID, 0, false
+	}
+
+	job := &deploy.DeployJob{
+		Deployment: preview,
+		Redeploy:   true,
+		Trigger:    deploy.TriggerWebhook,
+		Checkout: deploy.Checkout{
+			Branch:    pr.Ref,
+			CommitSHA: pr.CommitSHA,
+		},
+		Owner: owner,
+	}
+	if recordErr == nil {
+		job.DeliveryIDs = []string{delivery.ID}
+	}
+
+	return delivery.ID, s.deployService.EnqueueDeploy(job), true
+}
+
+func (s *Server) GetWebhookDeliveries(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	deliveries, err := s.deployService.GetWebhookDeliveries(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"deliveries": deliveries,
+	})
+}
+
+// PostWebhookReplay runs a stored delivery again for its deployment. Only
+// deliveries whose signature was valid can be replayed, and the replay is
+// stored as a delivery of its own.
+func (s *Server) PostWebhookReplay(c *gin.Context) {
+	deliveryId := c.Params.ByName("deliveryid")
+
+	original, err := s.deployService.GetWebhookDelivery(deliveryId)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "delivery not found",
+		})
+		return
+	}
+
+	if original.DeploymentID == "" || !s.userOwnsDeployment(c, original.DeploymentID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "delivery doesn't belong to user",
+		})
+		return
+	}
+
+	if !original.SignatureValid {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "only deliveries with a valid signature can be replayed",
+		})
+		return
+	}
+
+	provider, ok := webhookProviders[original.Provider]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unknown webhook provider",
+		})
+		return
+	}
+
+	push, isPush, err := parseWebhook(provider, http.Header(original.Headers), []byte(original.Body))
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	dep, err := s.deployService.GetDeploymentBasedOnID(original.DeploymentID)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	delivery := deploy.WebhookDelivery{
+		Provider:       original.Provider,
+		Headers:        original.Headers,
+		Body:           original.Body,
+		SignatureValid: true,
+		ReplayOf:       original.ID,
+	}
+
+	newDeliveryId, position, ok := s.deliverWebhook(&delivery, push, isPush, dep)
+
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "ignored",
+			"delivery_id": newDeliveryId,
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":         "accepted",
+		"delivery_id":    newDeliveryId,
+		"queue_position": position,
+	})
+}
+
+func (s *Server) PostWebhookSecret(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	dep, err := s.deployService.GetDeploymentBasedOnID(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	secret, err := s.deployService.RotateWebhookSecret(dep)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":         "success",
+		"webhook_secret": secret,
+	})
 }
 
 type EnvVar struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	BuildTime bool   `json:"build_time"`
+	Secret    bool   `json:"secret"`
 }
 
 func convertEnvvarsToDeployEnvvars(envs []EnvVar) []deploy.EnvVar {
@@ -71,8 +447,10 @@ func convertEnvvarsToDeployEnvvars(envs []EnvVar) []deploy.EnvVar {
 
 	for _, env := range envs {
 		result = append(result, deploy.EnvVar{
-			Key:   env.Key,
-			Value: env.Value,
+			Key:       env.Key,
+			Value:     env.Value,
+			BuildTime: env.BuildTime,
+			Secret:    env.Secret,
 		})
 	}
 
@@ -81,101 +459,784 @@ func convertEnvvarsToDeployEnvvars(envs []EnvVar) []deploy.EnvVar {
 
 func (s *Server) PostDeploy(c *gin.Context) {
 	type body struct {
-		CloneUrl  string   `json:"clone_url"`
-		RepoName  string   `json:"repo_name"`
-		Branch    string   `json:"branch"`
-		SubDomain string   `json:"subdomain"`
-		EnvVars   []EnvVar `json:"envs"`
-		Port      int      `json:"port"`
+		CloneUrl    string             `json:"clone_url"`
+		RepoName    string             `json:"repo_name"`
+		Branch      string             `json:"branch"`
+		SubDomain   string             `json:"subdomain"`
+		EnvVars     []EnvVar           `json:"envs"`
+		Port        int                `json:"port"`
+		HealthCheck deploy.HealthCheck `json:"health_check"`
+		// GitToken or DeployKey are for private repositories.
+		GitToken  string `json:"git_token"`
+		DeployKey bool   `json:"deploy_key"`
+		// Ref pins the first deploy to a commit SHA, tag or branch.
+		Ref            string `json:"ref"`
+		RootDir        string `json:"root_dir"`
+		DockerfilePath string `json:"dockerfile_path"`
+	}
+
+	var json body
+	err := c.ShouldBindJSON(&json)
+	sessionId := c.GetHeader("Authorization")
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+	}
+
+	if err := deploy.ValidateRef(json.Ref); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ses, err := s.userService.GetSessionByID(sessionId)
+
+	if err != nil {
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	deployment, err := s.deployService.NewDeployment(&deploy.Deployment{
+		SubDomain:      json.SubDomain,
+		CloneUrl:       json.CloneUrl,
+		Branch:         json.Branch,
+		RepoName:       json.RepoName,
+		EnvVars:        convertEnvvarsToDeployEnvvars(json.EnvVars),
+		Port:           json.Port,
+		HealthCheck:    json.HealthCheck,
+		RootDir:        json.RootDir,
+		DockerfilePath: json.DockerfilePath,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	_, err = s.userService.AddDeploymentToUser(&user.UserDeployment{
+		UserID:       ses.UserID,
+		DeploymentID: deployment.ID,
+	})
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+
+	}
+
+	if json.GitToken != "" {
+		err = s.deployService.SetAccessToken(deployment, json.GitToken)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	// the deploy key has to be added to the repository before the first
+	// deploy, which is then started with PUT /redeploy.
+	if json.DeployKey {
+		publicKey, err := s.deployService.GenerateDeployKey(deployment)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":         "ok",
+			"deployment_id":  deployment.ID,
+			"webhook_secret": deployment.WebhookSecret,
+			"deploy_key":     publicKey,
+		})
+		return
+	}
+
+	position := s.deployService.EnqueueDeploy(&deploy.DeployJob{
+		Deployment: deployment,
+		Redeploy:   false,
+		Trigger:    deploy.TriggerAPI,
+		Checkout:   deploy.Checkout{Ref: json.Ref},
+		Owner:      ses.UserID,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status":         "ok",
+		"deployment_id":  deployment.ID,
+		"webhook_secret": deployment.WebhookSecret,
+		"queue_position": position,
+	})
+}
+
+// PostDeployKey generates a new ssh deploy key for the deployment and returns
+// its public key, which has to be added to the repository.
+func (s *Server) PostDeployKey(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	dep, err := s.deployService.GetDeploymentBasedOnID(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	publicKey, err := s.deployService.GenerateDeployKey(dep)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"deploy_key": publicKey,
+	})
+}
+
+func (s *Server) PutGitToken(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	type body struct {
+		Token string `json:"token"`
+	}
+	var json body
+
+	if err := c.ShouldBindJSON(&json); err != nil || json.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+	}
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	err := s.deployService.SetAccessToken(&deploy.Deployment{ID: deploymentId}, json.Token)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+func (s *Server) GetGitCredential(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	credential, err := s.deployService.GetGitCredential(deploymentId)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"credential": credential,
+	})
+}
+
+func (s *Server) DeleteGitCredential(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	err := s.deployService.DeleteGitCredential(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+func (s *Server) PutEnv(c *gin.Context) {
+
+	type body struct {
+		Value string `json:"value"`
+		// BuildTime and Secret are kept as they are when left out.
+		BuildTime *bool `json:"build_time"`
+		Secret    *bool `json:"secret"`
+	}
+	var json body
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+
+	}
+
+	deploymentId := c.Param("deploymentid")
+	envId := c.Param("envid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	current, err := s.deployService.GetEnvVar(&deploy.Deployment{ID: deploymentId}, envId)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "env var not found",
+		})
+		return
+	}
+
+	buildTime := current.BuildTime
+	if json.BuildTime != nil {
+		buildTime = *json.BuildTime
+	}
+
+	secret := current.Secret
+	if json.Secret != nil {
+		secret = *json.Secret
+	}
+
+	err = s.deployService.UpdateEnvVar(&deploy.Deployment{
+		ID: deploymentId,
+	}, deploy.EnvVar{
+		Key: envId,
+	}, deploy.EnvVar{
+		Value:     json.Value,
+		BuildTime: buildTime,
+		Secret:    secret,
+	})
+
+	if errors.Is(err, deploy.ErrNoEnvKey) || errors.Is(err, deploy.ErrInvalidEnvVar) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		fmt.Println("{SERVER}: Error In Updating Env")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.applyEnv(c, deploymentId, current.BuildTime || buildTime))
+}
+
+func (s *Server) DeleteEnv(c *gin.Context) {
+
+	deploymentId := c.Param("deploymentid")
+	envId := c.Param("envid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	current, err := s.deployService.GetEnvVar(&deploy.Deployment{ID: deploymentId}, envId)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "env var not found",
+		})
+		return
+	}
+
+	err = s.deployService.DeleteEnvVar(&deploy.Deployment{
+		ID: deploymentId,
+	}, deploy.EnvVar{
+		Key: envId,
+	})
+
+	if err != nil {
+		fmt.Println("{SERVER}: Error In Updating Env")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.applyEnv(c, deploymentId, current.BuildTime))
+}
+
+func (s *Server) PostEnv(c *gin.Context) {
+
+	type body struct {
+		Envs []EnvVar `json:"envs"`
+	}
+
+	var json body
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+	}
+
+	deploymentId := c.Param("deploymentid")
+
+	exists := s.deployService.CheckDeploymentExistenceBasedOnId(deploymentId)
+
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "deployment doesn't exist",
+		})
+		return
+	}
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	deployenvs := convertEnvvarsToDeployEnvvars(json.Envs)
+	err := s.deployService.AddEnvs(&deploy.Deployment{
+		ID: deploymentId,
+	}, deployenvs)
+
+	if errors.Is(err, deploy.ErrNoEnvKey) || errors.Is(err, deploy.ErrInvalidEnvVar) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	rebuild := false
+	for _, env := range deployenvs {
+		rebuild = rebuild || env.BuildTime
+	}
+
+	c.JSON(http.StatusOK, s.applyEnv(c, deploymentId, rebuild))
+}
+
+// maxEnvFileSize limits the body of PutEnvs.
+const maxEnvFileSize = 1 << 20
+
+// GetEnvs returns the env vars of the deployment as JSON, or as a .env file
+// with ?format=dotenv. Secret values are never handed out.
+func (s *Server) GetEnvs(c *gin.Context) {
+	deploymentId := c.Param("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	envs, err := s.deployService.GetEnvVars(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	if c.Query("format") == "dotenv" {
+		c.Header("Content-Disposition", `attachment; filename=".env"`)
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(deploy.FormatDotEnv(envs)))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"envs": envs,
+	})
+}
+
+// PutEnvs sets many env vars at once from a .env file or, sent as JSON, a map
+// of names to values or to objects with value, build_time and secret. Vars
+// that aren't given are kept, or deleted with ?replace=true. Existing vars
+// keep their build_time and secret flags unless they are given.
+func (s *Server) PutEnvs(c *gin.Context) {
+	deploymentId := c.Param("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	current, err := s.deployService.GetEnvVars(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	envs, err := readEnvBody(c, current)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	rebuild, err := s.deployService.ReplaceEnvVars(&deploy.Deployment{
+		ID: deploymentId,
+	}, envs, c.Query("replace") == "true")
+
+	if errors.Is(err, deploy.ErrNoEnvKey) || errors.Is(err, deploy.ErrInvalidEnvVar) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.applyEnv(c, deploymentId, rebuild))
+}
+
+// readEnvBody reads the .env file or JSON map of a bulk env update. Vars
+// that are in current keep their flags unless the body sets them.
+func readEnvBody(c *gin.Context, current []deploy.EnvVar) ([]deploy.EnvVar, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxEnvFileSize))
+	if err != nil {
+		return nil, fmt.Errorf("body has to be smaller than %d bytes", maxEnvFileSize)
+	}
+
+	existing := make(map[string]deploy.EnvVar)
+	for _, env := range current {
+		existing[env.Key] = env
+	}
+
+	if c.ContentType() == "application/json" {
+		return parseEnvMap(body, existing)
+	}
+
+	envs, err := deploy.ParseDotEnv(string(body))
+	for i := range envs {
+		envs[i].BuildTime = existing[envs[i].Key].BuildTime
+		envs[i].Secret = existing[envs[i].Key].Secret
+	}
+
+	return envs, err
+}
+
+// parseEnvMap reads the JSON body of a bulk env update, sorted by name.
+func parseEnvMap(body []byte, existing map[string]deploy.EnvVar) ([]deploy.EnvVar, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(body, &values); err != nil {
+		return nil, errors.New("body has to be a JSON object of env vars")
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	envs := make([]deploy.EnvVar, 0, len(keys))
+	for _, key := range keys {
+		env := deploy.EnvVar{
+			Key:       key,
+			BuildTime: existing[key].BuildTime,
+			Secret:    existing[key].Secret,
+		}
+
+		if err := json.Unmarshal(values[key], &env.Value); err != nil {
+			var object struct {
+				Value     string `json:"value"`
+				BuildTime *bool  `json:"build_time"`
+				Secret    *bool  `json:"secret"`
+			}
+			if err := json.Unmarshal(values[key], &object); err != nil {
+				return nil, fmt.Errorf("%s has to be a string or an object with a value", key)
+			}
+
+			env.Value = object.Value
+			if object.BuildTime != nil {
+				env.BuildTime = *object.BuildTime
+			}
+			if object.Secret != nil {
+				env.Secret = *object.Secret
+			}
+		}
+
+		envs = append(envs, env)
+	}
+
+	return envs, nil
+}
+
+// applyEnv schedules the rollout of changed env vars when the request asks
+// for it with ?apply=true and returns the response to the change. Changes
+// made shortly after each other are rolled out together.
+func (s *Server) applyEnv(c *gin.Context, deploymentId string, rebuild bool) gin.H {
+	if c.Query("apply") != "true" {
+		return gin.H{
+			"status": "success",
+		}
+	}
+
+	at := s.deployService.ScheduleEnvRollout(deploymentId, rebuild, c.GetString("session"), s.dockerCli, s.events)
+
+	return gin.H{
+		"status":     "success",
+		"rollout_at": at,
+	}
+}
+
+// userEnvGroup returns the env group of the request's path if it belongs to
+// the user, and answers the request otherwise.
+func (s *Server) userEnvGroup(c *gin.Context) (*deploy.EnvGroup, bool) {
+	group, err := s.deployService.GetEnvGroup(c.Param("groupid"))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "env group not found",
+		})
+		return nil, false
+	}
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return nil, false
+	}
+
+	if group.OwnerID != c.GetString("session") {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "env group doesn't belong to user",
+		})
+		return nil, false
+	}
+
+	return group, true
+}
+
+func (s *Server) PostEnvGroup(c *gin.Context) {
+	type body struct {
+		Name string   `json:"name"`
+		Envs []EnvVar `json:"envs"`
+	}
+	var json body
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+	}
+
+	group, err := s.deployService.CreateEnvGroup(c.GetString("session"), json.Name, convertEnvvarsToDeployEnvvars(json.Envs))
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"group":  group,
+	})
+}
+
+func (s *Server) GetEnvGroups(c *gin.Context) {
+	groups, err := s.deployService.GetEnvGroups(c.GetString("session"))
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"groups": groups,
+	})
+}
+
+// GetEnvGroup returns the group with its vars, or with ?format=dotenv its
+// vars as a .env file.
+func (s *Server) GetEnvGroup(c *gin.Context) {
+	group, ok := s.userEnvGroup(c)
+	if !ok {
+		return
+	}
+
+	if c.Query("format") == "dotenv" {
+		c.Header("Content-Disposition", `attachment; filename=".env"`)
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(deploy.FormatDotEnv(group.EnvVars)))
+		return
+	}
+
+	deployments, err := s.deployService.GetEnvGroupDeployments(group.ID)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"group":       group,
+		"deployments": deployments,
+	})
+}
+
+// PutEnvGroup sets the vars of the group like PutEnvs. With ?apply=true every
+// deployment of the group rolls the change out, otherwise they pick it up on
+// their next rollout.
+func (s *Server) PutEnvGroup(c *gin.Context) {
+	group, ok := s.userEnvGroup(c)
+	if !ok {
+		return
 	}
 
-	var json body
-	err := c.ShouldBindJSON(&json)
-	sessionId := c.GetHeader("Authorization")
+	envs, err := readEnvBody(c, group.EnvVars)
 
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "bad body",
+			"error": err.Error(),
 		})
 		return
 	}
 
-	ses, err := s.userService.GetSessionByID(sessionId)
+	rebuild, err := s.deployService.ReplaceEnvGroupVars(group, envs, c.Query("replace") == "true")
 
-	if err != nil {
+	if errors.Is(err, deploy.ErrNoEnvKey) || errors.Is(err, deploy.ErrInvalidEnvVar) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal Server Error",
 		})
 		return
 	}
 
-	deployment, err := s.deployService.NewDeployment(&deploy.Deployment{
-		SubDomain: json.SubDomain,
-		CloneUrl:  json.CloneUrl,
-		Branch:    json.Branch,
-		RepoName:  json.RepoName,
-		EnvVars:   convertEnvvarsToDeployEnvvars(json.EnvVars),
-		Port:      json.Port,
-	})
-
-	if err != nil {
-		fmt.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": err.Error(),
+	if c.Query("apply") != "true" {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
 		})
 		return
 	}
 
-	_, err = s.userService.AddDeploymentToUser(&user.UserDeployment{
-		UserID:       ses.UserID,
-		DeploymentID: deployment.ID,
-	})
+	deployments, err := s.deployService.GetEnvGroupDeployments(group.ID)
 
 	if err != nil {
+		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": err.Error(),
+			"error": "Internal Server Error",
 		})
 		return
-
 	}
 
-	s.deployService.DSM_SetDeploying(deployment.ID)
-	go s.deployService.Deploy(deployment, s.dockerCli, false, s.sseChannel, s.errorChannel)
+	rollouts := make(map[string]time.Time)
+	for _, deploymentId := range deployments {
+		rollouts[deploymentId] = s.deployService.ScheduleEnvRollout(deploymentId, rebuild, c.GetString("session"), s.dockerCli, s.events)
+	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"status": "ok",
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"rollouts": rollouts,
 	})
 }
 
-func (s *Server) PutEnv(c *gin.Context) {
-
-	type body struct {
-		Value string `json:"value"`
-	}
-	var json body
-
-	if err := c.ShouldBindJSON(&json); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "bad body",
-		})
+func (s *Server) DeleteEnvGroup(c *gin.Context) {
+	group, ok := s.userEnvGroup(c)
+	if !ok {
 		return
-
 	}
 
-	deploymentId := c.Param("deploymentid")
-	envId := c.Param("envid")
-
-	err := s.deployService.UpdateEnvVar(&deploy.Deployment{
-		ID: deploymentId,
-	}, deploy.EnvVar{
-		Key: envId,
-	}, deploy.EnvVar{
-		Value: json.Value,
-	})
+	err := s.deployService.DeleteEnvGroup(group.ID)
 
 	if err != nil {
-		fmt.Println("{SERVER}: Error In Updating Env")
+		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal Server Error",
 		})
@@ -187,19 +1248,20 @@ func (s *Server) PutEnv(c *gin.Context) {
 	})
 }
 
-func (s *Server) DeleteEnv(c *gin.Context) {
-
+func (s *Server) GetDeploymentEnvGroups(c *gin.Context) {
 	deploymentId := c.Param("deploymentid")
-	envId := c.Param("envid")
 
-	err := s.deployService.DeleteEnvVar(&deploy.Deployment{
-		ID: deploymentId,
-	}, deploy.EnvVar{
-		Key: envId,
-	})
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	groups, err := s.deployService.GetDeploymentEnvGroups(deploymentId)
 
 	if err != nil {
-		fmt.Println("{SERVER}: Error In Updating Env")
+		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal Server Error",
 		})
@@ -207,16 +1269,20 @@ func (s *Server) DeleteEnv(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"status": "success",
+		"groups": groups,
 	})
 }
 
-func (s *Server) PostEnv(c *gin.Context) {
+// PutDeploymentEnvGroups attaches the given groups to the deployment in
+// order, replacing the ones it had. Later groups override earlier ones and
+// the deployment's own vars override all of them. Like other env changes it
+// takes effect on the next rollout, or right away with ?apply=true.
+func (s *Server) PutDeploymentEnvGroups(c *gin.Context) {
+	deploymentId := c.Param("deploymentid")
 
 	type body struct {
-		Envs []EnvVar `json:"envs"`
+		Groups []string `json:"groups"`
 	}
-
 	var json body
 
 	if err := c.ShouldBindJSON(&json); err != nil {
@@ -226,22 +1292,71 @@ func (s *Server) PostEnv(c *gin.Context) {
 		return
 	}
 
-	deploymentId := c.Param("deploymentid")
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
 
-	exists := s.deployService.CheckDeploymentExistenceBasedOnId(deploymentId)
+	rebuild := false
+	for _, groupId := range json.Groups {
+		group, err := s.deployService.GetEnvGroup(groupId)
 
-	if !exists {
+		if err != nil || group.OwnerID != c.GetString("session") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("env group %s not found", groupId),
+			})
+			return
+		}
+
+		for _, env := range group.EnvVars {
+			rebuild = rebuild || env.BuildTime
+		}
+	}
+
+	previous, err := s.deployService.GetDeploymentEnvGroups(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	for _, group := range previous {
+		for _, env := range group.EnvVars {
+			rebuild = rebuild || env.BuildTime
+		}
+	}
+
+	err = s.deployService.SetDeploymentEnvGroups(deploymentId, json.Groups)
+
+	if err != nil {
+		log.Println(err)
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "deployment doesn't exist",
+			"error": err.Error(),
 		})
 		return
 	}
 
-	deployenvs := convertEnvvarsToDeployEnvvars(json.Envs)
-	fmt.Println(deployenvs)
-	err := s.deployService.AddEnvs(&deploy.Deployment{
-		ID: deploymentId,
-	}, deployenvs)
+	c.JSON(http.StatusOK, s.applyEnv(c, deploymentId, rebuild))
+}
+
+// PostApplyEnv restarts the deployment's current image with its current env
+// vars, without building it again.
+func (s *Server) PostApplyEnv(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	dep, err := s.deployService.GetDeploymentBasedOnID(deploymentId)
 
 	if err != nil {
 		log.Println(err)
@@ -251,14 +1366,53 @@ func (s *Server) PostEnv(c *gin.Context) {
 		return
 	}
 
+	release, err := s.deployService.ApplyEnv(dep, s.dockerCli, s.events)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"status": "success",
+		"status":  "success",
+		"release": release,
 	})
 }
 
+// REDeploy queues a new deploy of the deployment. The body is optional and
+// can pin the deploy to a ref.
 func (s *Server) REDeploy(c *gin.Context) {
 	deploymentId := c.Param("deploymentid")
 
+	type body struct {
+		Ref string `json:"ref"`
+	}
+	var json body
+
+	if err := c.ShouldBindJSON(&json); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+	}
+
+	if err := deploy.ValidateRef(json.Ref); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
 	dep, err := s.deployService.GetDeploymentBasedOnID(deploymentId)
 
 	if err != nil {
@@ -266,20 +1420,30 @@ func (s *Server) REDeploy(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal Server Error",
 		})
+		return
 	}
 
-	err = s.deployService.DSM_SetDeploying(dep.ID)
+	owner, err := s.userService.GetDeploymentOwner(deploymentId)
+
 	if err != nil {
-		fmt.Println("error in DSM SET DEPLOYING")
-		log.Println(err.Error())
+		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal Server Error",
 		})
+		return
 	}
-	go s.deployService.Deploy(dep, s.dockerCli, true, s.sseChannel, s.errorChannel)
+
+	position := s.deployService.EnqueueDeploy(&deploy.DeployJob{
+		Deployment: dep,
+		Redeploy:   true,
+		Trigger:    deploy.TriggerRedeploy,
+		Checkout:   deploy.Checkout{Ref: json.Ref},
+		Owner:      owner,
+	})
 
 	c.JSON(http.StatusOK, gin.H{
-		"status": "success",
+		"status":         "success",
+		"queue_position": position,
 	})
 }
 
@@ -427,6 +1591,113 @@ func (s *Server) GetDeployment(c *gin.Context) {
 	})
 }
 
+func (s *Server) GetDeploymentReleases(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	releases, err := s.deployService.GetReleases(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"releases": releases,
+	})
+}
+
+func (s *Server) PutHealthCheck(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+
+	var json deploy.HealthCheck
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad body",
+		})
+		return
+	}
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	dep, err := s.deployService.GetDeploymentBasedOnID(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	err = s.deployService.UpdateHealthCheck(dep, json)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "success",
+		"health_check": dep.HealthCheck,
+	})
+}
+
+func (s *Server) PostRollback(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+	releaseId := c.Params.ByName("releaseid")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	dep, err := s.deployService.GetDeploymentBasedOnID(deploymentId)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	release, err := s.deployService.Rollback(dep, releaseId, s.dockerCli, s.events)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"release": release,
+	})
+}
+
 func (s *Server) GetContainerStats(c *gin.Context) {
 	deploymentId := c.Params.ByName("deploymentid")
 
@@ -484,6 +1755,14 @@ func (s *Server) GetContainerLogs(c *gin.Context) {
 
 func (s *Server) GetOngoingDeployments(c *gin.Context) {
 	did := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, did) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
 	state, err := s.deployService.DSM_GetDeploymentState(did)
 
 	if err != nil {
@@ -495,3 +1774,27 @@ func (s *Server) GetOngoingDeployments(c *gin.Context) {
 
 	c.JSON(http.StatusOK, state)
 }
+
+func (s *Server) DeleteOngoingDeployment(c *gin.Context) {
+	did := c.Params.ByName("deploymentid")
+
+	if !s.userOwnsDeployment(c, did) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	err := s.deployService.CancelDeploy(did)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "cancelled",
+	})
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Qu-Ack/orchestration/services/deploy"
 	"github.com/Qu-Ack/orchestration/services/user"
@@ -19,8 +25,9 @@ type Server struct {
 	db            *sql.DB
 	deployService *deploy.DeployService
 	userService   *user.UserService
-	sseChannel    chan string
-	errorChannel  chan string
+	events        chan deploy.DeployEvent
+	hub           *SseHub
+	streamTokens  *streamTokens
 }
 
 func NewDockerClient() *client.Client {
@@ -66,16 +73,136 @@ func (s *Server) ServerCleanUp() {
 
 func NewServer() *Server {
 	return &Server{
-		r:          gin.Default(),
-		dockerCli:  NewDockerClient(),
-		db:         NewDB(),
-		sseChannel: make(chan string, 100),
+		r:            gin.Default(),
+		dockerCli:    NewDockerClient(),
+		db:           NewDB(),
+		events:       make(chan deploy.DeployEvent, 100),
+		streamTokens: newStreamTokens(),
 	}
 }
 
+// buildWorkers is the number of deployments that may build at the same time,
+// configured through BUILD_WORKERS.
+func buildWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("BUILD_WORKERS"))
+	if err != nil || workers < 1 {
+		return 2
+	}
+	return workers
+}
+
+// durationFromEnv reads a duration like "10m" from the environment, zero if unset or invalid.
+func durationFromEnv(key string) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// decodeKey reads a key given as base64, as printed by `openssl rand -base64 32`.
+func decodeKey(key string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil
+	}
+	return decoded
+}
+
+// envKeys reads ENV_KEYS, a comma separated list of id:base64key pairs. The
+// first key encrypts new values, the others are kept to decrypt older ones.
+func envKeys(keys string) []deploy.EnvKey {
+	result := make([]deploy.EnvKey, 0)
+	for _, pair := range strings.Split(keys, ",") {
+		id, key, _ := strings.Cut(strings.TrimSpace(pair), ":")
+		result = append(result, deploy.EnvKey{
+			ID:  id,
+			Key: decodeKey(key),
+		})
+	}
+	return result
+}
+
+// statusHosts reads STATUS_HOSTS, a comma separated list of
+// host=provider:token entries like github.com=github:<token>. The older
+// STATUS_API_TOKEN and STATUS_API_URL configure a single GitHub style host.
+func statusHosts() map[string]deploy.StatusHost {
+	hosts := make(map[string]deploy.StatusHost, 0)
+
+	if token := os.Getenv("STATUS_API_TOKEN"); token != "" {
+		apiUrl := os.Getenv("STATUS_API_URL")
+		host := "github.com"
+		if u, err := url.Parse(apiUrl); err == nil && u.Host != "" && u.Hostname() != "api.github.com" {
+			host = u.Hostname()
+		}
+		hosts[host] = deploy.StatusHost{
+			Provider: deploy.StatusGithub,
+			APIURL:   apiUrl,
+			Token:    token,
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("STATUS_HOSTS"), ",") {
+		host, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		provider, token, _ := strings.Cut(rest, ":")
+		hosts[host] = deploy.StatusHost{
+			Provider: deploy.StatusProvider(provider),
+			Token:    token,
+		}
+	}
+
+	return hosts
+}
+
 func (s *Server) InstanitateServerServices() {
 	s.deployService = deploy.NewDeployService(s.db)
 	s.userService = user.NewUserService(s.db)
+	s.deployService.SetStepTimeouts(deploy.StepTimeouts{
+		Clone: durationFromEnv("CLONE_TIMEOUT"),
+		Build: durationFromEnv("BUILD_TIMEOUT"),
+		Start: durationFromEnv("START_TIMEOUT"),
+	})
+	s.deployService.SetEnvRolloutDelay(durationFromEnv("ENV_ROLLOUT_DELAY"))
+	s.deployService.SetCommitStatusConfig(deploy.CommitStatusConfig{
+		Hosts:     statusHosts(),
+		PublicURL: os.Getenv("PUBLIC_URL"),
+	})
+	// CREDENTIALS_KEY only opens git credentials stored before they moved to ENV_KEYS.
+	if key := os.Getenv("CREDENTIALS_KEY"); key != "" {
+		err := s.deployService.SetLegacyCredentialsKey(decodeKey(key))
+		if err != nil {
+			log.Println("{SERVER}: CREDENTIALS_KEY ignored:", err.Error())
+		}
+	}
+	if keys := os.Getenv("ENV_KEYS"); keys != "" {
+		err := s.deployService.SetEnvKeys(envKeys(keys))
+		if err != nil {
+			log.Println(err.Error())
+			log.Panic("{SERVER}: Invalid ENV_KEYS")
+		}
+
+		rotated, err := s.deployService.RotateEnvKeys()
+		if err != nil {
+			log.Println("{SERVER}: Error while rotating env keys:", err.Error())
+		}
+		if rotated > 0 {
+			log.Printf("{SERVER}: Encrypted %d env vars and git credentials with the active env key", rotated)
+		}
+	} else if os.Getenv("ALLOW_PLAINTEXT_ENV") == "true" {
+		log.Println("{SERVER}: ENV_KEYS not set, env vars are stored unencrypted")
+	} else {
+		log.Panic("{SERVER}: ENV_KEYS not set, set ALLOW_PLAINTEXT_ENV=true to store env vars unencrypted")
+	}
+	s.hub = NewSseHub(func(userId string, deploymentId string) bool {
+		_, err := s.userService.GetUserDeployment(userId, deploymentId)
+		return err == nil
+	})
+	go s.hub.Run(s.events)
+	s.deployService.StartBuildQueue(buildWorkers(), s.dockerCli, s.events)
+	s.deployService.StartStateSweeper(time.Minute)
 }
 
 func (s *Server) SetUpRoutes() {
@@ -85,13 +212,25 @@ func (s *Server) SetUpRoutes() {
 		})
 	})
 
-	s.r.GET("/active/:deploymentid", s.GetOngoingDeployments)
-	s.r.GET("/events", s.SseEvents)
+	s.r.GET("/active/:deploymentid", s.AuthMiddleware(), s.GetOngoingDeployments)
+	s.r.DELETE("/active/:deploymentid", s.AuthMiddleware(), s.DeleteOngoingDeployment)
+	s.r.POST("/events/token", s.AuthMiddleware(), s.PostStreamToken)
+	s.r.GET("/events", s.StreamAuthMiddleware(), s.SseEvents)
 	s.r.POST("/webhook", s.PostWebHook)
+	s.r.POST("/webhook/:provider", s.PostWebHook)
+	s.r.POST("/webhooks/:deliveryid/replay", s.AuthMiddleware(), s.PostWebhookReplay)
 	s.r.POST("/deploy", s.AuthMiddleware(), s.PostDeploy)
 	s.r.PUT("/env/:deploymentid/:envid", s.AuthMiddleware(), s.PutEnv)
 	s.r.DELETE("/env/:deploymentid/:envid", s.AuthMiddleware(), s.DeleteEnv)
 	s.r.POST("/env/:deploymentid", s.AuthMiddleware(), s.PostEnv)
+	s.r.GET("/env/:deploymentid", s.AuthMiddleware(), s.GetEnvs)
+	s.r.PUT("/env/:deploymentid", s.AuthMiddleware(), s.PutEnvs)
+	s.r.POST("/env-groups", s.AuthMiddleware(), s.PostEnvGroup)
+	s.r.GET("/env-groups", s.AuthMiddleware(), s.GetEnvGroups)
+	s.r.GET("/env-groups/:groupid", s.AuthMiddleware(), s.GetEnvGroup)
+	s.r.PUT("/env-groups/:groupid", s.AuthMiddleware(), s.PutEnvGroup)
+	s.r.DELETE("/env-groups/:groupid", s.AuthMiddleware(), s.DeleteEnvGroup)
+	s.r.POST("/env/:deploymentid/apply", s.AuthMiddleware(), s.PostApplyEnv)
 	s.r.PUT("/redeploy/:deploymentid", s.AuthMiddleware(), s.REDeploy)
 	s.r.POST("/login", s.PostLogin)
 	//	s.r.POST("/register", s.PostUser)
@@ -99,4 +238,16 @@ func (s *Server) SetUpRoutes() {
 	s.r.GET("/deployment/:deploymentid", s.AuthMiddleware(), s.GetDeployment)
 	s.r.GET("/deployment/:deploymentid/stats", s.AuthMiddleware(), s.GetContainerStats)
 	s.r.GET("/deployment/:deploymentid/logs", s.AuthMiddleware(), s.GetContainerLogs)
+	s.r.GET("/deployment/:deploymentid/releases", s.AuthMiddleware(), s.GetDeploymentReleases)
+	s.r.POST("/deployment/:deploymentid/rollback/:releaseid", s.AuthMiddleware(), s.PostRollback)
+	s.r.PUT("/deployment/:deploymentid/healthcheck", s.AuthMiddleware(), s.PutHealthCheck)
+	s.r.GET("/deployment/:deploymentid/build-logs", s.AuthMiddleware(), s.GetBuildLogs)
+	s.r.POST("/deployment/:deploymentid/webhook-secret", s.AuthMiddleware(), s.PostWebhookSecret)
+	s.r.GET("/deployment/:deploymentid/webhooks", s.AuthMiddleware(), s.GetWebhookDeliveries)
+	s.r.POST("/deployment/:deploymentid/deploy-key", s.AuthMiddleware(), s.PostDeployKey)
+	s.r.PUT("/deployment/:deploymentid/git-token", s.AuthMiddleware(), s.PutGitToken)
+	s.r.GET("/deployment/:deploymentid/git-credentials", s.AuthMiddleware(), s.GetGitCredential)
+	s.r.DELETE("/deployment/:deploymentid/git-credentials", s.AuthMiddleware(), s.DeleteGitCredential)
+	s.r.GET("/deployment/:deploymentid/env-groups", s.AuthMiddleware(), s.GetDeploymentEnvGroups)
+	s.r.PUT("/deployment/:deploymentid/env-groups", s.AuthMiddleware(), s.PutDeploymentEnvGroups)
 }
@@ -1,11 +1,155 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/Qu-Ack/orchestration/services/deploy"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	// number of past events kept around for clients reconnecting with Last-Event-ID
+	sseReplayBufferSize = 500
+	sseClientBufferSize = 64
+)
+
+type sseClient struct {
+	userId string
+	events chan deploy.DeployEvent
+	// deployments the user was checked against, only used under the hub mutex
+	allowed map[string]bool
+}
+
+// SseHub broadcasts deploy events to every connected client whose user owns
+// the deployment, and keeps the latest events so reconnecting clients can
+// catch up on what they missed.
+type SseHub struct {
+	mutex  sync.Mutex
+	nextID uint64
+	// ring of the latest events, oldest at head
+	buffer    [sseReplayBufferSize]deploy.DeployEvent
+	head      int
+	count     int
+	clients   map[*sseClient]struct{}
+	authorize func(userId string, deploymentId string) bool
+}
+
+func NewSseHub(authorize func(userId string, deploymentId string) bool) *SseHub {
+	return &SseHub{
+		clients:   make(map[*sseClient]struct{}),
+		authorize: authorize,
+	}
+}
+
+// Run broadcasts the events until the channel is closed.
+func (h *SseHub) Run(events <-chan deploy.DeployEvent) {
+	for event := range events {
+		h.broadcast(event)
+	}
+}
+
+// allows reports whether the client may see events of the deployment. Callers hold the mutex.
+func (h *SseHub) allows(client *sseClient, deploymentId string) bool {
+	allowed, ok := client.allowed[deploymentId]
+	if !ok {
+		allowed = h.authorize(client.userId, deploymentId)
+		client.allowed[deploymentId] = allowed
+	}
+	return allowed
+}
+
+func (h *SseHub) broadcast(event deploy.DeployEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.nextID++
+	event.ID = h.nextID
+
+	if h.count < sseReplayBufferSize {
+		h.buffer[(h.head+h.count)%sseReplayBufferSize] = event
+		h.count++
+	} else {
+		h.buffer[h.head] = event
+		h.head = (h.head + 1) % sseReplayBufferSize
+	}
+
+	for client := range h.clients {
+		if !h.allows(client, event.DeploymentID) {
+			continue
+		}
+
+		select {
+		case client.events <- event:
+		default:
+			// the client can't keep up, dropping it makes it reconnect and
+			// replay what it missed instead of silently losing events.
+			close(client.events)
+			delete(h.clients, client)
+		}
+	}
+}
+
+// subscribe registers a client for the user and returns it along with the
+// buffered events after lastEventId that the user may see.
+func (h *SseHub) subscribe(userId string, lastEventId uint64) (*sseClient, []deploy.DeployEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	client := &sseClient{
+		userId:  userId,
+		events:  make(chan deploy.DeployEvent, sseClientBufferSize),
+		allowed: make(map[string]bool),
+	}
+
+	replay := make([]deploy.DeployEvent, 0)
+	if lastEventId > 0 {
+		for i := 0; i < h.count; i++ {
+			event := h.buffer[(h.head+i)%sseReplayBufferSize]
+			if event.ID > lastEventId && h.allows(client, event.DeploymentID) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	h.clients[client] = struct{}{}
+	return client, replay
+}
+
+func (h *SseHub) unsubscribe(client *sseClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.clients[client]; ok {
+		close(client.events)
+		delete(h.clients, client)
+	}
+}
+
+func writeSseEvent(c *gin.Context, event deploy.DeployEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: deployment\ndata: %s\n\n", event.ID, data)
+	return err
+}
+
 func (s *Server) SseEvents(c *gin.Context) {
+	lastEventIdHeader := c.GetHeader("Last-Event-ID")
+	if lastEventIdHeader == "" {
+		lastEventIdHeader = c.Query("lastEventId")
+	}
+	lastEventId, _ := strconv.ParseUint(lastEventIdHeader, 10, 64)
+
+	client, replay := s.hub.subscribe(c.GetString("session"), lastEventId)
+	defer s.hub.unsubscribe(client)
+
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Header("Access-Control-Expose-Headers", "Content-Type")
 
@@ -13,14 +157,92 @@ func (s *Server) SseEvents(c *gin.Context) {
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
+	for _, event := range replay {
+		if err := writeSseEvent(c, event); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	c.Writer.Flush()
+
 	for {
 		select {
-		case update := <-s.sseChannel:
-			fmt.Fprintf(c.Writer, "data: update:%s\n\n", update)
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			if err := writeSseEvent(c, event); err != nil {
+				log.Println(err)
+				return
+			}
 			c.Writer.Flush()
-		case err := <-s.errorChannel:
-			fmt.Fprintf(c.Writer, "data: error:%s\n\n", err)
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// GetBuildLogs streams the clone and build output of a release line by line.
+// Without a release query parameter the latest release of the deployment is
+// used. Finished releases are replayed from the stored log.
+func (s *Server) GetBuildLogs(c *gin.Context) {
+	deploymentId := c.Params.ByName("deploymentid")
+	releaseId := c.Query("release")
+
+	if !s.userOwnsDeployment(c, deploymentId) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "deployment doesn't belong to user",
+		})
+		return
+	}
+
+	var release *deploy.Release
+	var err error
+	if releaseId == "" {
+		release, err = s.deployService.GetLatestRelease(deploymentId)
+	} else {
+		release, err = s.deployService.GetRelease(releaseId)
+	}
+
+	if err != nil || release.DeploymentID != deploymentId {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "release not found",
+		})
+		return
+	}
+
+	buildLog, err := s.deployService.GetBuildLog(release.ID)
+
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal Server Error",
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	sent := 0
+	for {
+		lines, done, changed := buildLog.Lines(sent)
+
+		for _, line := range lines {
+			fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", sent, line)
+			sent++
+		}
+
+		if done {
+			fmt.Fprintf(c.Writer, "event: end\ndata: %s\n\n", release.ID)
 			c.Writer.Flush()
+			return
+		}
+		c.Writer.Flush()
+
+		select {
+		case <-changed:
 		case <-c.Request.Context().Done():
 			return
 		}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Qu-Ack/orchestration/services/deploy"
+)
+
+// PushEvent is what a webhook carries about a push, whichever git host sent it.
+type PushEvent struct {
+	// CloneUrls are the URLs the repository can be cloned from (https, ssh).
+	CloneUrls     []string
+	DefaultBranch string
+	// Branches are the pushed branches. Pushed tags are left out, and events
+	// other than pushes have none.
+	Branches []BranchPush
+	// PullRequest is set for pull request events.
+	PullRequest *PullRequest
+}
+
+type BranchPush struct {
+	Branch    string
+	CommitSHA string
+	// Deleted is set when the branch was deleted by the push.
+	Deleted bool
+	Commits []PushCommit
+}
+
+// changedPaths returns the files added, modified or removed by the pushed commits.
+func (b BranchPush) changedPaths() []string {
+	paths := make([]string, 0)
+	for _, commit := range b.Commits {
+		paths = append(paths, commit.Added...)
+		paths = append(paths, commit.Modified...)
+		paths = append(paths, commit.Removed...)
+	}
+	return paths
+}
+
+type PullRequestAction int
+
+const (
+	// PullRequestIgnored changes don't touch the code, e.g. new labels.
+	PullRequestIgnored PullRequestAction = iota
+	// PullRequestUpdated pull requests were opened, reopened or got new commits.
+	PullRequestUpdated
+	// PullRequestClosed pull requests were closed or merged.
+	PullRequestClosed
+)
+
+type PullRequest struct {
+	Number int
+	Action PullRequestAction
+	// Ref is fetched from the repository to get the head of the pull request.
+	Ref        string
+	CommitSHA  string
+	BaseBranch string
+	// Fork pull requests come from another repository and are never built,
+	// since they would get the parent's env vars and git credential.
+	Fork bool
+}
+
+type PushCommit struct {
+	ID       string
+	Added    []string
+	Modified []string
+	Removed  []string
+}
+
+// WebhookProvider reads the webhooks of one git host.
+type WebhookProvider interface {
+	// Detect reports whether the request was sent by this host.
+	Detect(header http.Header) bool
+	// IsPush reports whether the request is a push event.
+	IsPush(header http.Header) bool
+	// Parse maps the payload into a PushEvent. Payloads of other events only
+	// fill in the repository.
+	Parse(body []byte) (*PushEvent, error)
+	// ParsePullRequest reads pull request events, it returns nil for others.
+	ParsePullRequest(header http.Header, body []byte) (*PullRequest, error)
+	// Verify checks the request against the deployment's webhook secret.
+	Verify(d *deploy.DeployService, dep *deploy.Deployment, header http.Header, body []byte) error
+}
+
+var webhookProviders = map[string]WebhookProvider{
+	"github":    githubProvider{},
+	"gitlab":    gitlabProvider{},
+	"gitea":     giteaProvider{},
+	"forgejo":   giteaProvider{},
+	"bitbucket": bitbucketProvider{},
+}
+
+// Gitea and Forgejo send GitHub's headers as well, so they are detected first.
+var webhookDetectionOrder = []string{"gitea", "gitlab", "bitbucket", "github"}
+
+// webhookProvider returns the provider named in the path, or the one that
+// recognises the request's headers, along with its name.
+func webhookProvider(name string, header http.Header) (WebhookProvider, string, bool) {
+	if name != "" {
+		provider, ok := webhookProviders[name]
+		return provider, name, ok
+	}
+
+	for _, name := range webhookDetectionOrder {
+		if webhookProviders[name].Detect(header) {
+			return webhookProviders[name], name, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// parseWebhook reads the request into a PushEvent, along with whether it is
+// a push.
+func parseWebhook(provider WebhookProvider, header http.Header, body []byte) (*PushEvent, bool, error) {
+	event, err := provider.Parse(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	event.PullRequest, err = provider.ParsePullRequest(header, body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return event, provider.IsPush(header), nil
+}
+
+// zeroSHA is sent as the new commit of deleted branches.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+func nonEmpty(values ...string) []string {
+	result := make([]string, 0)
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// parseGithubStylePush reads the payload format of GitHub, which Gitea and
+// Forgejo use too.
+func parseGithubStylePush(body []byte) (*PushEvent, error) {
+	var payload WebhookPayloadStruct
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	event := &PushEvent{
+		CloneUrls:     nonEmpty(payload.Repository.CloneUrl, payload.Repository.SshUrl),
+		DefaultBranch: payload.Repository.DefaultBranch,
+	}
+
+	branch, ok := deploy.BranchFromRef(payload.Ref)
+	if !ok {
+		return event, nil
+	}
+
+	push := BranchPush{
+		Branch:    branch,
+		CommitSHA: payload.After,
+		Deleted:   payload.Deleted || payload.After == zeroSHA,
+	}
+	for _, commit := range payload.Commits {
+		push.Commits = append(push.Commits, PushCommit{
+			ID:       commit.CommitHash,
+			Added:    commit.Added,
+			Modified: commit.Modified,
+			Removed:  commit.Removed,
+		})
+	}
+
+	event.Branches = append(event.Branches, push)
+	return event, nil
+}
+
+// parseGithubStylePullRequest reads the pull_request event of GitHub, Gitea
+// and Forgejo.
+func parseGithubStylePullRequest(body []byte) (*PullRequest, error) {
+	var payload WebhookPullRequestPayloadStruct
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	pr := &PullRequest{
+		Number:     payload.Number,
+		Ref:        fmt.Sprintf("refs/pull/%d/head", payload.Number),
+		CommitSHA:  payload.PullRequest.Head.Sha,
+		BaseBranch: payload.PullRequest.Base.Ref,
+		Fork:       payload.PullRequest.Head.Repo.Name != payload.PullRequest.Base.Repo.Name,
+	}
+
+	switch payload.Action {
+	case "opened", "reopened", "synchronize", "synchronized":
+		pr.Action = PullRequestUpdated
+	case "closed":
+		pr.Action = PullRequestClosed
+	}
+
+	return pr, nil
+}
+
+type githubProvider struct{}
+
+func (githubProvider) Detect(header http.Header) bool {
+	return header.Get("X-GitHub-Event") != ""
+}
+
+func (githubProvider) IsPush(header http.Header) bool {
+	return header.Get("X-GitHub-Event") == "push"
+}
+
+func (githubProvider) Parse(body []byte) (*PushEvent, error) {
+	return parseGithubStylePush(body)
+}
+
+func (githubProvider) ParsePullRequest(header http.Header, body []byte) (*PullRequest, error) {
+	if header.Get("X-GitHub-Event") != "pull_request" {
+		return nil, nil
+	}
+	return parseGithubStylePullRequest(body)
+}
+
+func (githubProvider) Verify(d *deploy.DeployService, dep *deploy.Deployment, header http.Header, body []byte) error {
+	return d.VerifyWebhookSignature(dep, body, header.Get("X-Hub-Signature-256"))
+}
+
+// giteaProvider reads the webhooks of Gitea and of Forgejo, which sends the
+// Gitea headers alongside its own.
+type giteaProvider struct{}
+
+func (giteaProvider) event(header http.Header) string {
+	if event := header.Get("X-Forgejo-Event"); event != "" {
+		return event
+	}
+	return header.Get("X-Gitea-Event")
+}
+
+func (p giteaProvider) Detect(header http.Header) bool {
+	return p.event(header) != ""
+}
+
+func (p giteaProvider) IsPush(header http.Header) bool {
+	return p.event(header) == "push"
+}
+
+func (giteaProvider) Parse(body []byte) (*PushEvent, error) {
+	return parseGithubStylePush(body)
+}
+
+func (p giteaProvider) ParsePullRequest(header http.Header, body []byte) (*PullRequest, error) {
+	if p.event(header) != "pull_request" {
+		return nil, nil
+	}
+	return parseGithubStylePullRequest(body)
+}
+
+func (giteaProvider) Verify(d *deploy.DeployService, dep *deploy.Deployment, header http.Header, body []byte) error {
+	signature := header.Get("X-Forgejo-Signature")
+	if signature == "" {
+		signature = header.Get("X-Gitea-Signature")
+	}
+	return d.VerifyWebhookHMAC(dep, body, signature)
+}
+
+// gitlabProvider reads GitLab webhooks, which send the secret itself as a
+// token instead of signing the body.
+type gitlabProvider struct{}
+
+func (gitlabProvider) Detect(header http.Header) bool {
+	return header.Get("X-Gitlab-Event") != ""
+}
+
+func (gitlabProvider) IsPush(header http.Header) bool {
+	return header.Get("X-Gitlab-Event") == "Push Hook"
+}
+
+func (gitlabProvider) Parse(body []byte) (*PushEvent, error) {
+	var payload GitlabPayloadStruct
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	event := &PushEvent{
+		CloneUrls:     nonEmpty(payload.Project.HttpUrl, payload.Project.SshUrl),
+		DefaultBranch: payload.Project.DefaultBranch,
+	}
+
+	branch, ok := deploy.BranchFromRef(payload.Ref)
+	if !ok {
+		return event, nil
+	}
+
+	push := BranchPush{
+		Branch:    branch,
+		CommitSHA: payload.After,
+		Deleted:   payload.After == zeroSHA,
+	}
+	for _, commit := range payload.Commits {
+		push.Commits = append(push.Commits, PushCommit{
+			ID:       commit.CommitHash,
+			Added:    commit.Added,
+			Modified: commit.Modified,
+			Removed:  commit.Removed,
+		})
+	}
+
+	event.Branches = append(event.Branches, push)
+	return event, nil
+}
+
+func (gitlabProvider) ParsePullRequest(header http.Header, body []byte) (*PullRequest, error) {
+	if header.Get("X-Gitlab-Event") != "Merge Request Hook" {
+		return nil, nil
+	}
+
+	var payload GitlabMergeRequestPayloadStruct
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	attrs := payload.ObjectAttributes
+	pr := &PullRequest{
+		Number:     attrs.IID,
+		Ref:        fmt.Sprintf("refs/merge-requests/%d/head", attrs.IID),
+		CommitSHA:  attrs.LastCommit.ID,
+		BaseBranch: attrs.TargetBranch,
+		Fork:       attrs.SourceProjectID != attrs.TargetProjectID,
+	}
+
+	switch attrs.Action {
+	case "open", "reopen":
+		pr.Action = PullRequestUpdated
+	case "update":
+		// updates without oldrev only changed the title, labels etc.
+		if attrs.OldRev != "" {
+			pr.Action = PullRequestUpdated
+		}
+	case "close", "merge":
+		pr.Action = PullRequestClosed
+	}
+
+	return pr, nil
+}
+
+func (gitlabProvider) Verify(d *deploy.DeployService, dep *deploy.Deployment, header http.Header, body []byte) error {
+	return d.VerifyWebhookToken(dep, header.Get("X-Gitlab-Token"))
+}
+
+// bitbucketProvider reads Bitbucket Cloud webhooks. Their push payloads don't
+// list the changed files of the commits.
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) Detect(header http.Header) bool {
+	return header.Get("X-Event-Key") != "" && strings.HasPrefix(header.Get("User-Agent"), "Bitbucket")
+}
+
+func (bitbucketProvider) IsPush(header http.Header) bool {
+	return header.Get("X-Event-Key") == "repo:push"
+}
+
+func (bitbucketProvider) Parse(body []byte) (*PushEvent, error) {
+	var payload BitbucketPayloadStruct
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	name := payload.Repository.Name
+	event := &PushEvent{
+		DefaultBranch: payload.Repository.MainBranch.Name,
+	}
+	if name != "" {
+		event.CloneUrls = []string{
+			"https://bitbucket.org/" + name + ".git",
+			"git@bitbucket.org:" + name + ".git",
+		}
+	}
+
+	// a single push can update several branches.
+	for _, change := range payload.Push.Changes {
+		if change.Closed || change.New == nil {
+			continue
+		}
+		if change.New.Type != "branch" {
+			continue
+		}
+
+		event.Branches = append(event.Branches, BranchPush{
+			Branch:    change.New.Name,
+			CommitSHA: change.New.Target.Hash,
+		})
+	}
+
+	return event, nil
+}
+
+// ParsePullRequest reads Bitbucket pull requests, which are built from their
+// source branch since Bitbucket has no refs for them.
+func (bitbucketProvider) ParsePullRequest(header http.Header, body []byte) (*PullRequest, error) {
+	event, ok := strings.CutPrefix(header.Get("X-Event-Key"), "pullrequest:")
+	if !ok {
+		return nil, nil
+	}
+
+	var payload BitbucketPullRequestPayloadStruct
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	source := payload.PullRequest.Source
+	pr := &PullRequest{
+		Number:     payload.PullRequest.ID,
+		Ref:        "refs/heads/" + source.Branch.Name,
+		CommitSHA:  source.Commit.Hash,
+		BaseBranch: payload.PullRequest.Destination.Branch.Name,
+		Fork:       source.Repository.Name != payload.PullRequest.Destination.Repository.Name,
+	}
+
+	switch event {
+	case "created", "updated":
+		pr.Action = PullRequestUpdated
+	case "fulfilled", "rejected":
+		pr.Action = PullRequestClosed
+	}
+
+	return pr, nil
+}
+
+func (bitbucketProvider) Verify(d *deploy.DeployService, dep *deploy.Deployment, header http.Header, body []byte) error {
+	return d.VerifyWebhookSignature(dep, body, header.Get("X-Hub-Signature"))
+}
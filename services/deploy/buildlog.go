@@ -0,0 +1,219 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// BuildLog collects the output of the clone and build steps of a release line
+// by line while the release is running. Readers follow it through Lines.
+type BuildLog struct {
+	mutex   sync.Mutex
+	lines   []string
+	partial []byte
+	changed chan struct{}
+	done    bool
+}
+
+func newBuildLog() *BuildLog {
+	return &BuildLog{
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *BuildLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.done {
+		return len(p), nil
+	}
+
+	l.partial = append(l.partial, p...)
+	appended := false
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.lines = append(l.lines, strings.TrimRight(string(l.partial[:i]), "\r"))
+		l.partial = l.partial[i+1:]
+		appended = true
+	}
+
+	if appended {
+		l.notify()
+	}
+
+	return len(p), nil
+}
+
+// Printf writes a line of our own, like the start of a step, into the log.
+func (l *BuildLog) Printf(format string, args ...any) {
+	fmt.Fprintf(l, format+"\n", args...)
+}
+
+// notify wakes up every reader waiting on the changed channel. Callers hold the mutex.
+func (l *BuildLog) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Lines returns the lines starting at index from, whether the log is complete
+// and a channel that is closed as soon as more lines arrive.
+func (l *BuildLog) Lines(from int) ([]string, bool, <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var lines []string
+	if from < len(l.lines) {
+		lines = append(lines, l.lines[from:]...)
+	}
+
+	return lines, l.done, l.changed
+}
+
+func (l *BuildLog) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.done {
+		return
+	}
+
+	if len(l.partial) > 0 {
+		l.lines = append(l.lines, strings.TrimRight(string(l.partial), "\r"))
+		l.partial = nil
+	}
+	l.done = true
+	l.notify()
+}
+
+// maskingWriter passes output on line by line with secret values masked.
+type maskingWriter struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	replacer *strings.Replacer
+	partial  []byte
+}
+
+func newMaskingWriter(out io.Writer, secrets []string) *maskingWriter {
+	pairs := make([]string, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, maskedValue)
+	}
+
+	return &maskingWriter{
+		out:      out,
+		replacer: strings.NewReplacer(pairs...),
+	}
+}
+
+func (w *maskingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.partial = append(w.partial, p...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	_, err := io.WriteString(w.out, w.replacer.Replace(string(w.partial[:i+1])))
+	w.partial = w.partial[i+1:]
+	return len(p), err
+}
+
+// Flush writes out what is left of an unfinished line.
+func (w *maskingWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.partial) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.out, w.replacer.Replace(string(w.partial)))
+	w.partial = nil
+	return err
+}
+
+func (l *BuildLog) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return strings.Join(l.lines, "\n")
+}
+
+func (d *DeployService) startBuildLog(releaseId string) *BuildLog {
+	d.buildLogsMutex.Lock()
+	defer d.buildLogsMutex.Unlock()
+
+	buildLog := newBuildLog()
+	d.buildLogs[releaseId] = buildLog
+	return buildLog
+}
+
+// finishBuildLog closes the live log of the release and stores it with the
+// release. The live log is only dropped once it is persisted so readers never
+// miss it in between.
+func (d *DeployService) finishBuildLog(release *Release) {
+	d.buildLogsMutex.RLock()
+	buildLog, ok := d.buildLogs[release.ID]
+	d.buildLogsMutex.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	buildLog.Close()
+
+	err := d.repo.updateReleaseBuildLog(release.ID, buildLog.String())
+	if err != nil {
+		fmt.Println("ERROR WHILE STORING BUILD LOG")
+		fmt.Println(err)
+	}
+
+	d.buildLogsMutex.Lock()
+	delete(d.buildLogs, release.ID)
+	d.buildLogsMutex.Unlock()
+}
+
+// buildLogf writes a line into the live log of the release, if it has one.
+func (d *DeployService) buildLogf(release *Release, format string, args ...any) {
+	d.buildLogsMutex.RLock()
+	buildLog, ok := d.buildLogs[release.ID]
+	d.buildLogsMutex.RUnlock()
+
+	if ok {
+		buildLog.Printf(format, args...)
+	}
+}
+
+// GetBuildLog returns the live log of a running release, or a closed log
+// holding the stored output of a finished one.
+func (d *DeployService) GetBuildLog(releaseId string) (*BuildLog, error) {
+	d.buildLogsMutex.RLock()
+	buildLog, ok := d.buildLogs[releaseId]
+	d.buildLogsMutex.RUnlock()
+
+	if ok {
+		return buildLog, nil
+	}
+
+	stored, err := d.repo.getReleaseBuildLog(releaseId)
+	if err != nil {
+		return nil, err
+	}
+
+	buildLog = newBuildLog()
+	if stored != "" {
+		buildLog.lines = strings.Split(stored, "\n")
+	}
+	buildLog.done = true
+
+	return buildLog, nil
+}
@@ -0,0 +1,285 @@
+package deploy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type CredentialKind string
+
+const (
+	// CredentialDeployKey deployments clone over ssh with a key pair generated
+	// for them, the public key has to be added to the repository.
+	CredentialDeployKey CredentialKind = "deploy_key"
+	// CredentialToken deployments clone over https with an access token.
+	CredentialToken CredentialKind = "token"
+)
+
+// GitCredential is what a deployment authenticates to its repository with.
+// The secret part is never handed out.
+type GitCredential struct {
+	DeploymentID string         `json:"deployment_id"`
+	Kind         CredentialKind `json:"kind"`
+	PublicKey    string         `json:"public_key,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	secret       []byte
+	// sealed, dataKey and keyID are the secret as stored, see EnvVar.
+	sealed  []byte
+	dataKey []byte
+	keyID   string
+}
+
+// SetLegacyCredentialsKey sets the key git credentials were encrypted with
+// before they moved to the env keys. It is only used by RotateEnvKeys to
+// move them over and can be dropped afterwards.
+func (d *DeployService) SetLegacyCredentialsKey(key []byte) error {
+	box, err := newSecretBox(key)
+	if err != nil {
+		return err
+	}
+
+	d.legacyCredentials = box
+	return nil
+}
+
+// credentialAdditionalData binds an encrypted credential to its deployment.
+func credentialAdditionalData(deploymentId string) string {
+	return "git_credentials/" + deploymentId
+}
+
+// sealGitCredential encrypts the secret of the credential with the env keys.
+func (d *DeployService) sealGitCredential(credential *GitCredential) error {
+	if d.envKeys == nil {
+		return ErrNoEnvKey
+	}
+
+	sealed, dataKey, keyID, err := d.envKeys.seal(credential.secret, credentialAdditionalData(credential.DeploymentID))
+	if err != nil {
+		return err
+	}
+
+	credential.sealed, credential.dataKey, credential.keyID = sealed, dataKey, keyID
+	return nil
+}
+
+func (d *DeployService) openGitCredential(credential *GitCredential) error {
+	var err error
+	switch {
+	case credential.keyID == "" && d.legacyCredentials != nil:
+		credential.secret, err = d.legacyCredentials.open(credential.sealed, credential.DeploymentID)
+	case credential.keyID == "":
+		return errors.New("git credential was sealed with CREDENTIALS_KEY, which is not set")
+	case d.envKeys == nil:
+		return ErrNoEnvKey
+	default:
+		credential.secret, err = d.envKeys.open(credential.sealed, credential.dataKey, credential.keyID, credentialAdditionalData(credential.DeploymentID))
+	}
+	if err != nil {
+		return fmt.Errorf("decrypting git credential: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DeployService) saveGitCredential(credential *GitCredential) error {
+	err := d.sealGitCredential(credential)
+	if err != nil {
+		return err
+	}
+
+	credential.CreatedAt = time.Now()
+
+	err = d.repo.upsertGitCredential(credential)
+	if err != nil {
+		fmt.Println("ERROR WHILE SAVING GIT CREDENTIAL")
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// GenerateDeployKey creates a new ed25519 key pair for the deployment,
+// replacing its previous credential, and returns the public key in
+// authorized_keys format.
+func (d *DeployService) GenerateDeployKey(deployment *Deployment) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+
+	comment := "orchestration-" + deployment.ID
+	block, err := ssh.MarshalPrivateKey(private, comment)
+	if err != nil {
+		return "", err
+	}
+
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic))) + " " + comment
+
+	err = d.saveGitCredential(&GitCredential{
+		DeploymentID: deployment.ID,
+		Kind:         CredentialDeployKey,
+		PublicKey:    publicKey,
+		secret:       pem.EncodeToMemory(block),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return publicKey, nil
+}
+
+// SetAccessToken makes the deployment clone with an https access token,
+// replacing its previous credential.
+func (d *DeployService) SetAccessToken(deployment *Deployment, token string) error {
+	if token == "" {
+		return errors.New("token can't be empty")
+	}
+
+	return d.saveGitCredential(&GitCredential{
+		DeploymentID: deployment.ID,
+		Kind:         CredentialToken,
+		secret:       []byte(token),
+	})
+}
+
+// GetGitCredential returns the credential of the deployment, or nil if it
+// clones without one.
+func (d *DeployService) GetGitCredential(deploymentId string) (*GitCredential, error) {
+	credential, err := d.repo.getGitCredential(deploymentId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.openGitCredential(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+func (d *DeployService) DeleteGitCredential(deploymentId string) error {
+	return d.repo.deleteGitCredential(deploymentId)
+}
+
+// rotateGitCredentials seals the git credentials that aren't wrapped with the
+// active env key yet, including those sealed with the former CREDENTIALS_KEY.
+func (d *DeployService) rotateGitCredentials() (int, error) {
+	stale, err := d.repo.getGitCredentialsNotSealedWith(d.envKeys.activeID)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, credential := range stale {
+		err := d.openGitCredential(credential)
+		if err != nil {
+			return rotated, fmt.Errorf("git credential of %s: %w", credential.DeploymentID, err)
+		}
+
+		err = d.sealGitCredential(credential)
+		if err != nil {
+			return rotated, err
+		}
+
+		err = d.repo.upsertGitCredential(credential)
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+
+	return rotated, nil
+}
+
+// copyGitCredential gives a preview deployment the credential of its parent.
+func (d *DeployService) copyGitCredential(from *Deployment, to *Deployment) error {
+	credential, err := d.GetGitCredential(from.ID)
+	if err != nil || credential == nil {
+		return err
+	}
+
+	credential.DeploymentID = to.ID
+	return d.saveGitCredential(credential)
+}
+
+// gitEnvKeys are the variables of the server's environment git, ssh and
+// git-lfs get. Everything else, like ENV_KEYS, stays out of their reach.
+var gitEnvKeys = []string{"PATH", "HOME", "USER", "LANG", "LC_ALL", "TMPDIR", "SSL_CERT_FILE", "SSL_CERT_DIR", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// gitEnv returns the environment git runs with for the deployment and a
+// function removing the files it needed. Deploy keys are written to a
+// temporary file for ssh, tokens are handed to git through a credential
+// helper reading them from the environment.
+func (d *DeployService) gitEnv(deployment *Deployment) ([]string, func(), error) {
+	// fail instead of waiting for a password on repositories that need one.
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	for _, key := range gitEnvKeys {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	cleanup := func() {}
+
+	credential, err := d.GetGitCredential(deployment.ID)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	if credential == nil {
+		return env, cleanup, nil
+	}
+
+	switch credential.Kind {
+	case CredentialDeployKey:
+		keyFile, err := os.CreateTemp("", "deploy-key-*")
+		if err != nil {
+			return nil, cleanup, err
+		}
+		cleanup = func() { os.Remove(keyFile.Name()) }
+
+		_, err = keyFile.Write(credential.secret)
+		keyFile.Close()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+
+		env = append(env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", keyFile.Name()))
+	case CredentialToken:
+		// the helper only answers for the clone url's host, so submodules
+		// and lfs servers elsewhere never see the token.
+		u, err := url.Parse(deployment.CloneUrl)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, cleanup, fmt.Errorf("tokens need an https clone url, got %q", deployment.CloneUrl)
+		}
+
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			fmt.Sprintf("GIT_CONFIG_KEY_0=credential.https://%s.helper", u.Host),
+			`GIT_CONFIG_VALUE_0=!f() { test "$1" = get && echo username=x-access-token && echo "password=$ORCHESTRATION_GIT_TOKEN"; }; f`,
+			"ORCHESTRATION_GIT_TOKEN="+string(credential.secret),
+		)
+	}
+
+	return env, cleanup, nil
+}
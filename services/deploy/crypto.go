@@ -0,0 +1,155 @@
+package deploy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// secretBox encrypts secrets stored in the database with AES-GCM. The
+// additional data binds a ciphertext to the row it belongs to.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != 32 {
+		return nil, errors.New("keys have to be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretBox{aead: aead}, nil
+}
+
+// seal returns the nonce followed by the ciphertext.
+func (b *secretBox) seal(plaintext []byte, additionalData string) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return b.aead.Seal(nonce, nonce, plaintext, []byte(additionalData)), nil
+}
+
+func (b *secretBox) open(sealed []byte, additionalData string) ([]byte, error) {
+	if len(sealed) < b.aead.NonceSize() {
+		return nil, errors.New("sealed secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	return b.aead.Open(nil, nonce, ciphertext, []byte(additionalData))
+}
+
+var ErrNoEnvKey = errors.New("no env key configured")
+
+// EnvKey is a master key env vars and git credentials are encrypted with. The
+// ID is stored next to every value so keys can be rotated.
+type EnvKey struct {
+	ID  string
+	Key []byte
+}
+
+// keyring seals every env value and git credential with a data key of its
+// own and wraps the data key with the active master key. The other keys are
+// only kept to unwrap data keys that weren't rotated yet.
+type keyring struct {
+	activeID string
+	boxes    map[string]*secretBox
+}
+
+func newKeyring(keys []EnvKey) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no env keys given")
+	}
+
+	k := &keyring{
+		activeID: keys[0].ID,
+		boxes:    make(map[string]*secretBox),
+	}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("env keys need an id")
+		}
+		if _, ok := k.boxes[key.ID]; ok {
+			return nil, fmt.Errorf("env key %q is given twice", key.ID)
+		}
+
+		box, err := newSecretBox(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("env key %q: %w", key.ID, err)
+		}
+		k.boxes[key.ID] = box
+	}
+
+	return k, nil
+}
+
+// seal encrypts the plaintext with a new data key and returns it with the
+// wrapped data key and the id of the key that wrapped it.
+func (k *keyring) seal(plaintext []byte, additionalData string) ([]byte, []byte, string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, "", err
+	}
+
+	box, err := newSecretBox(dataKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	sealed, err := box.seal(plaintext, additionalData)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	wrapped, err := k.boxes[k.activeID].seal(dataKey, additionalData)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return sealed, wrapped, k.activeID, nil
+}
+
+func (k *keyring) open(sealed []byte, wrapped []byte, keyID string, additionalData string) ([]byte, error) {
+	dataKey, err := k.unwrap(wrapped, keyID, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	box, err := newSecretBox(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return box.open(sealed, additionalData)
+}
+
+// rewrap wraps a data key with the active key, the value it sealed stays as it is.
+func (k *keyring) rewrap(wrapped []byte, keyID string, additionalData string) ([]byte, error) {
+	dataKey, err := k.unwrap(wrapped, keyID, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.boxes[k.activeID].seal(dataKey, additionalData)
+}
+
+func (k *keyring) unwrap(wrapped []byte, keyID string, additionalData string) ([]byte, error) {
+	box, ok := k.boxes[keyID]
+	if !ok {
+		return nil, fmt.Errorf("env key %q is not configured", keyID)
+	}
+
+	return box.open(wrapped, additionalData)
+}
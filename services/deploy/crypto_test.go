@@ -0,0 +1,168 @@
+package deploy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k, err := newKeyring([]EnvKey{{ID: "k1", Key: testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, wrapped, keyID, err := k.seal([]byte("value"), "dep/KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "k1" {
+		t.Errorf("sealed with %q, want k1", keyID)
+	}
+
+	got, err := k.open(sealed, wrapped, keyID, "dep/KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "value" {
+		t.Errorf("opened %q, want value", got)
+	}
+
+	if _, err := k.open(sealed, wrapped, keyID, "other/KEY"); err == nil {
+		t.Error("opened with the additional data of another value")
+	}
+}
+
+func TestKeyringRetiredKey(t *testing.T) {
+	old, err := newKeyring([]EnvKey{{ID: "k1", Key: testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, wrapped, keyID, err := old.seal([]byte("value"), "dep/KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := newKeyring([]EnvKey{{ID: "k2", Key: testKey(2)}, {ID: "k1", Key: testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := k.open(sealed, wrapped, keyID, "dep/KEY")
+	if err != nil {
+		t.Fatalf("opening with the retired key: %v", err)
+	}
+	if string(got) != "value" {
+		t.Errorf("opened %q, want value", got)
+	}
+
+	rewrapped, err := k.rewrap(wrapped, keyID, "dep/KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// once rewrapped, the retired key isn't needed anymore.
+	current, err := newKeyring([]EnvKey{{ID: "k2", Key: testKey(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = current.open(sealed, rewrapped, "k2", "dep/KEY")
+	if err != nil {
+		t.Fatalf("opening the rewrapped value: %v", err)
+	}
+	if string(got) != "value" {
+		t.Errorf("opened %q, want value", got)
+	}
+
+	if _, err := current.open(sealed, wrapped, "k1", "dep/KEY"); err == nil {
+		t.Error("opened a value wrapped with a key that is gone")
+	}
+}
+
+func TestNewKeyringRejectsBadKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []EnvKey
+	}{
+		{"no keys", nil},
+		{"short key", []EnvKey{{ID: "k1", Key: testKey(1)[:16]}}},
+		{"undecodable key", []EnvKey{{ID: "k1", Key: nil}}},
+		{"missing id", []EnvKey{{ID: "", Key: testKey(1)}}},
+		{"duplicate id", []EnvKey{{ID: "k1", Key: testKey(1)}, {ID: "k1", Key: testKey(2)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newKeyring(tt.keys); err == nil {
+				t.Error("keyring accepted the keys")
+			}
+		})
+	}
+}
+
+func TestKeyringUnknownKeyID(t *testing.T) {
+	k, err := newKeyring([]EnvKey{{ID: "k1", Key: testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, wrapped, _, err := k.seal([]byte("value"), "dep/KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.open(sealed, wrapped, "k9", "dep/KEY"); err == nil {
+		t.Error("opened with an unknown key id")
+	}
+	if _, err := k.rewrap(wrapped, "k9", "dep/KEY"); err == nil {
+		t.Error("rewrapped with an unknown key id")
+	}
+}
+
+func TestRotateEnvVar(t *testing.T) {
+	old, err := newKeyring([]EnvKey{{ID: "k1", Key: testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := newKeyring([]EnvKey{{ID: "k2", Key: testKey(2)}, {ID: "k1", Key: testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &DeployService{envKeys: old}
+	sealed, err := d.sealEnvVars("dep", []EnvVar{{Key: "KEY", Value: "value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.envKeys = k
+	tests := []struct {
+		name string
+		env  EnvVar
+		want string
+	}{
+		{"plain", EnvVar{Key: "PLAIN", Value: "plain"}, "plain"},
+		{"retired key", sealed[0], "value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotated, err := d.rotateEnvVar("dep", tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated.keyID != "k2" || rotated.Value != "" {
+				t.Fatalf("rotated to key %q with value %q, want k2 and no plain value", rotated.keyID, rotated.Value)
+			}
+
+			if err := d.openEnvVar("dep", &rotated); err != nil {
+				t.Fatal(err)
+			}
+			if rotated.Value != tt.want {
+				t.Errorf("opened %q, want %q", rotated.Value, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package deploy
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookDeliveryLimit is how many of the latest deliveries are listed for a deployment.
+const webhookDeliveryLimit = 50
+
+// headers that carry a secret itself rather than a signature of the body.
+var redactedWebhookHeaders = []string{"X-Gitlab-Token", "Authorization", "Cookie"}
+
+// RecordWebhookDelivery stores a received webhook. Headers that carry secrets
+// are stored redacted.
+func (d *DeployService) RecordWebhookDelivery(delivery *WebhookDelivery) error {
+	delivery.ID = String(8)
+	if delivery.ReceivedAt.IsZero() {
+		delivery.ReceivedAt = time.Now()
+	}
+
+	headers := make(map[string][]string, len(delivery.Headers))
+	for key, values := range delivery.Headers {
+		headers[http.CanonicalHeaderKey(key)] = values
+	}
+	for _, key := range redactedWebhookHeaders {
+		if _, ok := headers[key]; ok {
+			headers[key] = []string{"[redacted]"}
+		}
+	}
+	delivery.Headers = headers
+
+	err := d.repo.addWebhookDelivery(delivery)
+	if err != nil {
+		log.Printf("{SERVER}: failed to add webhook delivery: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+func (d *DeployService) GetWebhookDelivery(deliveryId string) (*WebhookDelivery, error) {
+	return d.repo.getWebhookDelivery(deliveryId)
+}
+
+// GetWebhookDeliveries returns the latest deliveries of the deployment, newest first.
+func (d *DeployService) GetWebhookDeliveries(deploymentId string) ([]*WebhookDelivery, error) {
+	return d.repo.getWebhookDeliveriesForDeployment(deploymentId, webhookDeliveryLimit)
+}
+
+// linkDeliveries records the release that the deliveries of a job resulted in.
+func (d *DeployService) linkDeliveries(job *DeployJob, release *Release) {
+	if len(job.DeliveryIDs) == 0 {
+		return
+	}
+
+	err := d.repo.setDeliveriesRelease(job.DeliveryIDs, release.ID)
+	if err != nil {
+		log.Println("{SERVER}: ERROR IN LINKING WEBHOOK DELIVERIES")
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,166 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxEnvKeyLength   = 255
+	maxEnvValueLength = 32 << 10
+	maxEnvVars        = 500
+)
+
+var ErrInvalidEnvVar = errors.New("invalid env vars")
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateEnvVars checks the names and sizes of env vars that are about to be
+// stored and that no key is given twice.
+func ValidateEnvVars(envs []EnvVar) error {
+	if len(envs) > maxEnvVars {
+		return fmt.Errorf("%w: at most %d env vars can be set at once", ErrInvalidEnvVar, maxEnvVars)
+	}
+
+	seen := make(map[string]bool)
+	for _, env := range envs {
+		if len(env.Key) > maxEnvKeyLength {
+			return fmt.Errorf("%w: env var name %.20s... is longer than %d characters", ErrInvalidEnvVar, env.Key, maxEnvKeyLength)
+		}
+		if !envKeyPattern.MatchString(env.Key) {
+			return fmt.Errorf("%w: name %q has to start with a letter or _ followed by letters, digits and _", ErrInvalidEnvVar, env.Key)
+		}
+		if seen[env.Key] {
+			return fmt.Errorf("%w: env var %s is given twice", ErrInvalidEnvVar, env.Key)
+		}
+		seen[env.Key] = true
+
+		if err := validateEnvValue(env); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateEnvValue(env EnvVar) error {
+	if len(env.Value) > maxEnvValueLength {
+		return fmt.Errorf("%w: value of env var %s is larger than %d bytes", ErrInvalidEnvVar, env.Key, maxEnvValueLength)
+	}
+	// build-time values end up in the generated Dockerfile, where a newline
+	// would start a new instruction.
+	if env.BuildTime && strings.ContainsAny(env.Value, "\r\n") {
+		return fmt.Errorf("%w: build-time env var %s can't contain newlines", ErrInvalidEnvVar, env.Key)
+	}
+	return nil
+}
+
+// ParseDotEnv reads a .env file. Values can be unquoted, single quoted taken
+// as they are, or double quoted with \n style escapes and spanning several
+// lines. Lines starting with # and `export ` prefixes are skipped.
+func ParseDotEnv(data string) ([]EnvVar, error) {
+	envs := make([]EnvVar, 0)
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(line, "export "); ok {
+			line = strings.TrimSpace(rest)
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimLeft(value, " \t")
+
+		switch {
+		case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+			quote := value[0]
+			raw := value[1:]
+			end := closingQuote(raw, quote)
+			for end < 0 {
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("line %d: unterminated quoted value of %s", lineNo, key)
+				}
+				raw += "\n" + lines[i]
+				end = closingQuote(raw, quote)
+			}
+
+			rest := strings.TrimSpace(raw[end+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: unexpected %q after the value of %s", lineNo, rest, key)
+			}
+
+			value = raw[:end]
+			if quote == '"' {
+				value = unescapeDotEnv(value)
+			}
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			value = strings.TrimSpace(value)
+		}
+
+		envs = append(envs, EnvVar{
+			Key:   key,
+			Value: value,
+		})
+	}
+
+	return envs, nil
+}
+
+// closingQuote returns the index of the quote ending the value, skipping
+// escaped ones in double quoted values, or -1 if the value goes on.
+func closingQuote(value string, quote byte) int {
+	for i := 0; i < len(value); i++ {
+		if quote == '"' && value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+var dotEnvUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n", `\r`, "\r", `\t`, "\t")
+var dotEnvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+func unescapeDotEnv(value string) string {
+	return dotEnvUnescaper.Replace(value)
+}
+
+// FormatDotEnv writes the env vars as a .env file sorted by name. Secrets
+// are write-only, they are listed in a comment without their value.
+func FormatDotEnv(envs []EnvVar) string {
+	sorted := make([]EnvVar, len(envs))
+	copy(sorted, envs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	var b strings.Builder
+	for _, env := range sorted {
+		if env.Secret {
+			fmt.Fprintf(&b, "# %s is a secret, its value is not exported\n", env.Key)
+			continue
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"\n", env.Key, dotEnvEscaper.Replace(env.Value))
+	}
+
+	return b.String()
+}
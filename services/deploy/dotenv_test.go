@@ -0,0 +1,48 @@
+package deploy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDotEnvRoundTripKeepsSecrets(t *testing.T) {
+	current := []EnvVar{
+		{Key: "API_URL", Value: "https://example.com"},
+		{Key: "GREETING", Value: "say \"hi\"\nand $leave"},
+		{Key: "TOKEN", Value: "s3cret", Secret: true},
+	}
+
+	exported := FormatDotEnv(current)
+
+	imported, err := ParseDotEnv(exported)
+	if err != nil {
+		t.Fatalf("parsing the export: %v", err)
+	}
+
+	envs := keepSecrets(current, imported)
+	slices.SortFunc(envs, func(a, b EnvVar) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	if len(envs) != len(current) {
+		t.Fatalf("got %d vars after the round trip, want %d: %+v", len(envs), len(current), envs)
+	}
+	for i, env := range envs {
+		if env.Key != current[i].Key || env.Value != current[i].Value || env.Secret != current[i].Secret {
+			t.Errorf("var %d = %+v, want %+v", i, env, current[i])
+		}
+	}
+	if buildTimeChanged(current, envs, true) {
+		t.Error("round trip reported a build time change")
+	}
+}
+
+func TestKeepSecretsPrefersGivenValues(t *testing.T) {
+	current := []EnvVar{{Key: "TOKEN", Value: "old", Secret: true}}
+	envs := keepSecrets(current, []EnvVar{{Key: "TOKEN", Value: "new", Secret: true}})
+
+	if len(envs) != 1 || envs[0].Value != "new" {
+		t.Fatalf("got %+v, want only the new TOKEN", envs)
+	}
+}
@@ -1,78 +1,159 @@
 package deploy
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"time"
 )
 
-func (d *DeployService) DSM_SetDeploying(deploymentId string) error {
-	d.dsm.mutex.Lock()
-	defer d.dsm.mutex.Unlock()
+// time on top of the step timeouts before the sweeper considers a deploy stuck.
+const sweeperGracePeriod = 5 * time.Minute
+
+var ErrInvalidTransition = errors.New("invalid deployment state transition")
+
+// stateTransitions lists the states a deployment may move to from each state.
+// A deployment enters the machine by being queued and every finished deploy
+// may be queued again.
+var stateTransitions = map[DeploymentStatus][]DeploymentStatus{
+	StatusQueued:    {StatusQueued, StatusCloning, StatusStarting, StatusCancelled, StatusFailed},
+	StatusCloning:   {StatusBuilding, StatusFailed, StatusCancelled},
+	StatusBuilding:  {StatusStarting, StatusFailed, StatusCancelled},
+	StatusStarting:  {StatusHealthy, StatusFailed, StatusCancelled},
+	StatusHealthy:   {StatusQueued},
+	StatusFailed:    {StatusQueued},
+	StatusCancelled: {StatusQueued},
+}
 
-	val, ok := d.dsm.States[deploymentId]
+// inProgressStatuses are the states of a deployment that has not finished yet.
+var inProgressStatuses = []DeploymentStatus{StatusQueued, StatusCloning, StatusBuilding, StatusStarting}
 
-	if !ok {
-		d.dsm.States[deploymentId] = &DeploymentState{
-			Status:    StatusDeploying,
-			StartTime: time.Now(),
-			Message:   "Deploying..",
-		}
-		fmt.Println("successfully added deployment to dsm")
-		return nil
-	} else {
-		if val.Status == StatusDeploying {
-			return fmt.Errorf("already deploying")
+// allowedFrom returns the states a deployment may be in to move to the given one.
+func allowedFrom(to DeploymentStatus) []string {
+	from := make([]string, 0)
+	for status, next := range stateTransitions {
+		for _, n := range next {
+			if n == to {
+				from = append(from, string(status))
+			}
 		}
-
-		val.Status = StatusDeploying
-		return nil
 	}
+	return from
 }
 
-func (d *DeployService) DSM_DeleteDeployment(deploymentId string) error {
-	d.dsm.mutex.Lock()
-	defer d.dsm.mutex.Unlock()
-
-	_, ok := d.dsm.States[deploymentId]
+// DSM_Transition moves the deployment to the given state. It fails with
+// ErrInvalidTransition if the current state doesn't lead there, e.g. when a
+// deployment that is building gets queued again.
+func (d *DeployService) DSM_Transition(deploymentId string, to DeploymentStatus, releaseId string, message string) error {
+	ok, err := d.repo.transitionState(deploymentId, to, allowedFrom(to), releaseId, message)
+	if err != nil {
+		fmt.Println("ERROR WHILE UPDATING DEPLOYMENT STATE")
+		fmt.Println(err)
+		return err
+	}
 
 	if !ok {
-		return fmt.Errorf("deployment doesn't exist")
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, deploymentId, to)
 	}
 
-	delete(d.dsm.States, deploymentId)
-	fmt.Println("successfully removed deployment to dsm")
 	return nil
 }
 
+// dsmTransition is DSM_Transition for the deploy pipeline, where a state that
+// can't be recorded is logged but doesn't stop the deploy.
+func (d *DeployService) dsmTransition(deploymentId string, to DeploymentStatus, releaseId string, message string) {
+	err := d.DSM_Transition(deploymentId, to, releaseId, message)
+	if err != nil {
+		log.Println("{SERVER}: ERROR IN DSM TRANSITION")
+		log.Println(err.Error())
+	}
+}
+
+// DSM_GetDeploymentState returns the state of the deployment. A deployment that
+// waits in this server's build queue carries its place in the queue.
 func (d *DeployService) DSM_GetDeploymentState(deploymentId string) (*DeploymentState, error) {
-	d.dsm.mutex.RLock()
+	state, err := d.repo.getState(deploymentId)
+	if err != nil {
+		return nil, fmt.Errorf("no such deployment with id: %s", deploymentId)
+	}
+
+	state.QueuePosition, _, _ = d.queue.status(deploymentId)
 
-	defer d.dsm.mutex.RUnlock()
+	return state, nil
+}
 
-	val, ok := d.dsm.States[deploymentId]
+func (d *DeployService) DSM_GetOngoingDeployments() (map[string]*DeploymentState, error) {
+	states, err := d.repo.getStatesWithStatus(inProgressStatuses)
+	if err != nil {
+		return nil, err
+	}
 
-	if !ok {
-		return nil, fmt.Errorf("no such deployment with id: %s", deploymentId)
+	for id, state := range states {
+		state.QueuePosition, _, _ = d.queue.status(id)
 	}
 
-	return val, nil
+	return states, nil
 }
 
-func (d *DeployService) DSM_GetOngoingDeployments() map[string]*DeploymentState {
-	d.dsm.mutex.RLock()
-	defer d.dsm.mutex.RUnlock()
-
-	ongoingDeployments := make(map[string]*DeploymentState)
-	for k, v := range d.dsm.States {
-		if v.Status == StatusDeploying {
-			stateCopy := &DeploymentState{
-				Status:    v.Status,
-				StartTime: v.StartTime,
-				Message:   v.Message,
-			}
-			ongoingDeployments[k] = stateCopy
-		}
+// failInterruptedDeploys fails the deployments and releases that were in
+// progress when the server stopped. The build queue only lives in memory, so
+// nothing would finish them and they would block new deploys until the
+// sweeper gives up on them. It has to run before the workers start.
+func (d *DeployService) failInterruptedDeploys() {
+	now := time.Now()
+
+	ids, err := d.repo.failStaleStates(inProgressStatuses, now, "server restarted")
+	if err != nil {
+		log.Println("{SERVER}: ERROR WHILE FAILING INTERRUPTED DEPLOYMENTS")
+		log.Println(err.Error())
+	}
+	for _, id := range ids {
+		log.Println("{SERVER}: marked interrupted deployment as failed:", id)
+	}
+
+	count, err := d.repo.failStaleReleases(now, StepRestart, "server restarted")
+	if err != nil {
+		log.Println("{SERVER}: ERROR WHILE FAILING INTERRUPTED RELEASES")
+		log.Println(err.Error())
+		return
+	}
+	if count > 0 {
+		log.Printf("{SERVER}: marked %d interrupted releases as failed\n", count)
 	}
+}
+
+// StartStateSweeper periodically fails deployments and releases that have
+// been in progress for longer than all step timeouts together allow, which
+// happens when a server goes down in the middle of a deploy.
+func (d *DeployService) StartStateSweeper(interval time.Duration) {
+	maxAge := d.timeouts.Clone + d.timeouts.Build + d.timeouts.Start + sweeperGracePeriod
 
-	return ongoingDeployments
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			cutoff := time.Now().Add(-maxAge)
+
+			stale, err := d.repo.failStaleStates(inProgressStatuses, cutoff, fmt.Sprintf("no progress for %v", maxAge))
+			if err != nil {
+				fmt.Println("ERROR WHILE FAILING STALE DEPLOYMENTS")
+				fmt.Println(err)
+			}
+			for _, id := range stale {
+				fmt.Println("{SERVER}: marked stale deployment as failed:", id)
+			}
+
+			reason := fmt.Sprintf("release did not finish within %v", maxAge)
+			count, err := d.repo.failStaleReleases(cutoff, StepTimeout, reason)
+			if err != nil {
+				fmt.Println("ERROR WHILE FAILING STALE RELEASES")
+				fmt.Println(err)
+				continue
+			}
+			if count > 0 {
+				fmt.Printf("{SERVER}: marked %d stale releases as failed\n", count)
+			}
+		}
+	}()
 }
@@ -0,0 +1,275 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maskedValue replaces secret values wherever they would be read back.
+const maskedValue = "********"
+
+// MarshalJSON masks the value of secrets.
+func (e EnvVar) MarshalJSON() ([]byte, error) {
+	type plain EnvVar
+	p := plain(e)
+	if p.Secret {
+		p.Value = maskedValue
+	}
+	return json.Marshal(p)
+}
+
+// SetEnvKeys sets the master keys env values and git credentials are
+// encrypted with, the first one wraps new values. Without keys, values are
+// stored in plain and neither secrets nor git credentials can be set.
+func (d *DeployService) SetEnvKeys(keys []EnvKey) error {
+	k, err := newKeyring(keys)
+	if err != nil {
+		return err
+	}
+
+	d.envKeys = k
+	return nil
+}
+
+// envAdditionalData binds an encrypted value to its key and scope, the ID of
+// the deployment or the envGroupScope of the group it belongs to.
+func envAdditionalData(scope string, key string) string {
+	return scope + "/" + key
+}
+
+// sealEnvVars returns the vars as they are stored, encrypted if there is a key.
+func (d *DeployService) sealEnvVars(scope string, envs []EnvVar) ([]EnvVar, error) {
+	result := make([]EnvVar, 0, len(envs))
+	for _, env := range envs {
+		if d.envKeys == nil {
+			if env.Secret {
+				return nil, ErrNoEnvKey
+			}
+			result = append(result, env)
+			continue
+		}
+
+		sealed, dataKey, keyID, err := d.envKeys.seal([]byte(env.Value), envAdditionalData(scope, env.Key))
+		if err != nil {
+			return nil, err
+		}
+
+		env.Value = ""
+		env.sealed, env.dataKey, env.keyID = sealed, dataKey, keyID
+		result = append(result, env)
+	}
+
+	return result, nil
+}
+
+func (d *DeployService) openEnvVar(scope string, env *EnvVar) error {
+	if env.keyID == "" {
+		return nil
+	}
+	if d.envKeys == nil {
+		return ErrNoEnvKey
+	}
+
+	value, err := d.envKeys.open(env.sealed, env.dataKey, env.keyID, envAdditionalData(scope, env.Key))
+	if err != nil {
+		return fmt.Errorf("decrypting env var %s: %w", env.Key, err)
+	}
+
+	env.Value = string(value)
+	return nil
+}
+
+func (d *DeployService) openEnvVars(deployment *Deployment) error {
+	for i := range deployment.EnvVars {
+		err := d.openEnvVar(deployment.ID, &deployment.EnvVars[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateEnvKeys encrypts the values of deployments and env groups that are
+// still stored in plain and wraps the data keys of the others and of the git
+// credentials with the active key, after which older keys can be dropped. It
+// returns how many vars and credentials were changed.
+func (d *DeployService) RotateEnvKeys() (int, error) {
+	if d.envKeys == nil {
+		return 0, ErrNoEnvKey
+	}
+
+	stale, err := d.repo.getEnvVarsNotSealedWith(d.envKeys.activeID)
+	if err != nil {
+		return 0, err
+	}
+
+	staleGroups, err := d.repo.getEnvGroupVarsNotSealedWith(d.envKeys.activeID)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for deploymentId, envs := range stale {
+		deployment := &Deployment{ID: deploymentId}
+		for _, env := range envs {
+			env, err := d.rotateEnvVar(deploymentId, env)
+			if err != nil {
+				return rotated, err
+			}
+
+			err = d.repo.updateEnvVar(deployment, env, env)
+			if err != nil {
+				return rotated, err
+			}
+			rotated++
+		}
+	}
+
+	for groupId, envs := range staleGroups {
+		for _, env := range envs {
+			env, err := d.rotateEnvVar(envGroupScope(groupId), env)
+			if err != nil {
+				return rotated, err
+			}
+
+			err = d.repo.updateEnvGroupVar(groupId, env)
+			if err != nil {
+				return rotated, err
+			}
+			rotated++
+		}
+	}
+
+	credentials, err := d.rotateGitCredentials()
+	return rotated + credentials, err
+}
+
+// rotateEnvVar seals a plain var, or wraps the data key of a sealed one with the active key.
+func (d *DeployService) rotateEnvVar(scope string, env EnvVar) (EnvVar, error) {
+	if env.keyID == "" {
+		sealed, err := d.sealEnvVars(scope, []EnvVar{env})
+		if err != nil {
+			return env, err
+		}
+		return sealed[0], nil
+	}
+
+	dataKey, err := d.envKeys.rewrap(env.dataKey, env.keyID, envAdditionalData(scope, env.Key))
+	if err != nil {
+		return env, fmt.Errorf("rewrapping env var %s of %s: %w", env.Key, scope, err)
+	}
+
+	env.dataKey = dataKey
+	env.keyID = d.envKeys.activeID
+	return env, nil
+}
+
+// secretValues returns the values that are masked in build logs.
+func secretValues(envs []EnvVar) []string {
+	values := make([]string, 0)
+	for _, env := range envs {
+		if env.Secret && strings.TrimSpace(env.Value) != "" {
+			values = append(values, env.Value)
+		}
+	}
+	return values
+}
+
+// GetEnvVars returns the env vars of the deployment sorted by name.
+func (d *DeployService) GetEnvVars(deploymentId string) ([]EnvVar, error) {
+	envs, err := d.repo.GetEnvVarsForDeployment(deploymentId)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment := &Deployment{ID: deploymentId, EnvVars: envs}
+	err = d.openEnvVars(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	return deployment.EnvVars, nil
+}
+
+// ReplaceEnvVars sets the env vars in one go, adding new ones and updating
+// existing ones. With replace, vars that aren't given are deleted, except
+// for secrets, which exports leave out and have to be deleted one by one. It
+// reports whether a build time var changed, which needs a redeploy to take
+// effect.
+func (d *DeployService) ReplaceEnvVars(deployment *Deployment, envs []EnvVar, replace bool) (bool, error) {
+	err := ValidateEnvVars(envs)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := d.GetEnvVars(deployment.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if replace {
+		envs = keepSecrets(current, envs)
+	}
+
+	rebuild := buildTimeChanged(current, envs, replace)
+
+	sealed, err := d.sealEnvVars(deployment.ID, envs)
+	if err != nil {
+		return false, err
+	}
+
+	err = d.repo.upsertEnvVars(deployment, sealed, replace)
+	if err != nil {
+		fmt.Println("ERROR WHILE REPLACING ENV VARS")
+		fmt.Println(err)
+		return false, err
+	}
+
+	return rebuild, nil
+}
+
+// keepSecrets adds the secrets of current that envs leaves out, so replacing
+// the vars with an exported .env file doesn't delete them.
+func keepSecrets(current []EnvVar, envs []EnvVar) []EnvVar {
+	given := make(map[string]bool, len(envs))
+	for _, env := range envs {
+		given[env.Key] = true
+	}
+
+	result := slices.Clone(envs)
+	for _, env := range current {
+		if env.Secret && !given[env.Key] {
+			result = append(result, env)
+		}
+	}
+
+	return result
+}
+
+// buildTimeChanged reports whether setting envs over current, deleting the
+// others with replace, changes a build time var.
+func buildTimeChanged(current []EnvVar, envs []EnvVar, replace bool) bool {
+	previous := make(map[string]EnvVar)
+	for _, env := range current {
+		previous[env.Key] = env
+	}
+
+	changed := false
+	for _, env := range envs {
+		old, ok := previous[env.Key]
+		delete(previous, env.Key)
+		if ok && old.Value == env.Value && old.BuildTime == env.BuildTime {
+			continue
+		}
+		changed = changed || env.BuildTime || old.BuildTime
+	}
+	if replace {
+		for _, old := range previous {
+			changed = changed || old.BuildTime
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,221 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// envGroupScope is what the vars of a group are encrypted for, deployments
+// use their ID.
+func envGroupScope(groupId string) string {
+	return "group/" + groupId
+}
+
+func (d *DeployService) CreateEnvGroup(ownerId string, name string, envs []EnvVar) (*EnvGroup, error) {
+	if name == "" || len(name) > 255 {
+		return nil, errors.New("env group name has to be 1 to 255 characters")
+	}
+
+	err := ValidateEnvVars(envs)
+	if err != nil {
+		return nil, err
+	}
+
+	group := &EnvGroup{
+		ID:        String(8),
+		OwnerID:   ownerId,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+
+	sealed, err := d.sealEnvVars(envGroupScope(group.ID), envs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.repo.addEnvGroup(group)
+	if err != nil {
+		fmt.Println("ERROR WHILE ADDING ENV GROUP")
+		fmt.Println(err)
+		return nil, err
+	}
+
+	err = d.repo.upsertEnvGroupVars(group.ID, sealed, false)
+	if err != nil {
+		fmt.Println("ERROR WHILE ADDING ENV GROUP VARS")
+		fmt.Println(err)
+		return nil, err
+	}
+
+	group.EnvVars = envs
+	return group, nil
+}
+
+// GetEnvGroup returns the group with its vars.
+func (d *DeployService) GetEnvGroup(groupId string) (*EnvGroup, error) {
+	group, err := d.repo.getEnvGroup(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.loadEnvGroupVars(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// GetEnvGroups returns the groups of the user with their vars.
+func (d *DeployService) GetEnvGroups(ownerId string) ([]*EnvGroup, error) {
+	groups, err := d.repo.getEnvGroupsForOwner(ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		err := d.loadEnvGroupVars(group)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+func (d *DeployService) loadEnvGroupVars(group *EnvGroup) error {
+	envs, err := d.repo.getEnvGroupVars(group.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range envs {
+		err := d.openEnvVar(envGroupScope(group.ID), &envs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	group.EnvVars = envs
+	return nil
+}
+
+// ReplaceEnvGroupVars sets the vars of the group like ReplaceEnvVars does for
+// a deployment. The deployments of the group pick the change up on their next
+// rollout.
+func (d *DeployService) ReplaceEnvGroupVars(group *EnvGroup, envs []EnvVar, replace bool) (bool, error) {
+	err := ValidateEnvVars(envs)
+	if err != nil {
+		return false, err
+	}
+
+	rebuild := buildTimeChanged(group.EnvVars, envs, replace)
+
+	sealed, err := d.sealEnvVars(envGroupScope(group.ID), envs)
+	if err != nil {
+		return false, err
+	}
+
+	err = d.repo.upsertEnvGroupVars(group.ID, sealed, replace)
+	if err != nil {
+		fmt.Println("ERROR WHILE REPLACING ENV GROUP VARS")
+		fmt.Println(err)
+		return false, err
+	}
+
+	return rebuild, nil
+}
+
+// DeleteEnvGroup removes the group from every deployment it was attached to.
+func (d *DeployService) DeleteEnvGroup(groupId string) error {
+	return d.repo.deleteEnvGroup(groupId)
+}
+
+// GetEnvGroupDeployments returns the IDs of the deployments the group is attached to.
+func (d *DeployService) GetEnvGroupDeployments(groupId string) ([]string, error) {
+	return d.repo.getEnvGroupDeployments(groupId)
+}
+
+// SetDeploymentEnvGroups attaches the groups to the deployment, replacing
+// the ones it had. Later groups override earlier ones.
+func (d *DeployService) SetDeploymentEnvGroups(deploymentId string, groupIds []string) error {
+	seen := make(map[string]bool)
+	for _, groupId := range groupIds {
+		if seen[groupId] {
+			return fmt.Errorf("env group %s is given twice", groupId)
+		}
+		seen[groupId] = true
+	}
+
+	return d.repo.setDeploymentEnvGroups(deploymentId, groupIds)
+}
+
+// GetDeploymentEnvGroups returns the groups of the deployment in the order
+// they are applied, with their vars.
+func (d *DeployService) GetDeploymentEnvGroups(deploymentId string) ([]*EnvGroup, error) {
+	groups, err := d.repo.getDeploymentEnvGroups(deploymentId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		err := d.loadEnvGroupVars(group)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+// copyEnvGroups attaches the groups of a deployment to its preview.
+func (d *DeployService) copyEnvGroups(from *Deployment, to *Deployment) error {
+	groups, err := d.repo.getDeploymentEnvGroups(from.ID)
+	if err != nil || len(groups) == 0 {
+		return err
+	}
+
+	groupIds := make([]string, 0, len(groups))
+	for _, group := range groups {
+		groupIds = append(groupIds, group.ID)
+	}
+
+	return d.repo.setDeploymentEnvGroups(to.ID, groupIds)
+}
+
+// ResolveEnvVars returns the vars a rollout of the deployment runs with, read
+// at the time of the rollout: those of its groups in order, each overriding
+// the ones before, and then the deployment's own.
+func (d *DeployService) ResolveEnvVars(deploymentId string) ([]EnvVar, error) {
+	groups, err := d.GetDeploymentEnvGroups(deploymentId)
+	if err != nil {
+		return nil, err
+	}
+
+	own, err := d.GetEnvVars(deploymentId)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]EnvVar)
+	for _, group := range groups {
+		for _, env := range group.EnvVars {
+			resolved[env.Key] = env
+		}
+	}
+	for _, env := range own {
+		resolved[env.Key] = env
+	}
+
+	envs := make([]EnvVar, 0, len(resolved))
+	for _, env := range resolved {
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Key < envs[j].Key
+	})
+
+	return envs, nil
+}
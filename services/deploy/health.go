@@ -0,0 +1,117 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+const (
+	defaultHealthCheckStatus  = 200
+	defaultHealthCheckTimeout = 5
+	defaultHealthCheckRetries = 10
+
+	healthCheckInterval = 2 * time.Second
+)
+
+var ErrHealthCheckFailed = errors.New("health check failed")
+
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.ExpectedStatus == 0 {
+		h.ExpectedStatus = defaultHealthCheckStatus
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = defaultHealthCheckTimeout
+	}
+	if h.Retries <= 0 {
+		h.Retries = defaultHealthCheckRetries
+	}
+	return h
+}
+
+func (d *DeployService) UpdateHealthCheck(deployment *Deployment, healthCheck HealthCheck) error {
+	if healthCheck.Path != "" && healthCheck.Path[0] != '/' {
+		return errors.New("health check path must start with /")
+	}
+
+	deployment.HealthCheck = healthCheck.withDefaults()
+
+	err := d.repo.updateHealthCheck(deployment)
+	if err != nil {
+		fmt.Println("ERROR WHILE UPDATING HEALTH CHECK")
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// healthCheckCommand requests the health check path from inside the
+// container with curl, or wget where there is no curl, and succeeds on the
+// expected status.
+func healthCheckCommand(deployment *Deployment, healthCheck HealthCheck) string {
+	url := shellQuote(fmt.Sprintf("http://127.0.0.1:%v%v", deployment.Port, healthCheck.Path))
+	return fmt.Sprintf(`if command -v curl >/dev/null; then test "$(curl -s -o /dev/null -w '%%{http_code}' %s)" = %d; else wget -q -S -O /dev/null %s 2>&1 | grep -q "HTTP/[0-9.]* %d "; fi`,
+		url, healthCheck.ExpectedStatus, url, healthCheck.ExpectedStatus)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// dockerHealthCheck turns the health check of the deployment into the docker
+// health check of its containers. Traefik doesn't route to containers that
+// have one until they are healthy. Nil without a path.
+func dockerHealthCheck(deployment *Deployment) *container.HealthConfig {
+	if deployment.HealthCheck.Path == "" {
+		return nil
+	}
+
+	healthCheck := deployment.HealthCheck.withDefaults()
+	return &container.HealthConfig{
+		Test:     []string{"CMD-SHELL", healthCheckCommand(deployment, healthCheck)},
+		Interval: healthCheckInterval,
+		Timeout:  time.Duration(healthCheck.Timeout) * time.Second,
+		Retries:  healthCheck.Retries,
+	}
+}
+
+// waitForHealthy waits until docker reports the container healthy. It fails
+// once docker gave up on it after the retries of the health check.
+func (d *DeployService) waitForHealthy(ctx context.Context, containerId string, dockerCli *client.Client) error {
+	for {
+		info, err := dockerCli.ContainerInspect(ctx, containerId)
+		if err != nil {
+			return err
+		}
+
+		if !info.State.Running {
+			return fmt.Errorf("container exited with code %d", info.State.ExitCode)
+		}
+		if info.State.Health == nil {
+			return errors.New("container has no health check")
+		}
+
+		switch info.State.Health.Status {
+		case container.Healthy:
+			return nil
+		case container.Unhealthy:
+			lastErr := "no output"
+			if logs := info.State.Health.Log; len(logs) > 0 {
+				lastErr = fmt.Sprintf("exit code %d %s", logs[len(logs)-1].ExitCode, strings.TrimSpace(logs[len(logs)-1].Output))
+			}
+			return fmt.Errorf("%w: %s", ErrHealthCheckFailed, lastErr)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
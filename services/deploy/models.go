@@ -1,7 +1,6 @@
 package deploy
 
 import (
-	"sync"
 	"time"
 )
 
@@ -15,21 +14,98 @@ const (
 type DeploymentStatus string
 
 const (
-	StatusIdle      DeploymentStatus = "idle"
-	StatusDeploying DeploymentStatus = "deploying"
-	StatusCompleted DeploymentStatus = "completed"
+	StatusQueued    DeploymentStatus = "queued"
+	StatusCloning   DeploymentStatus = "cloning"
+	StatusBuilding  DeploymentStatus = "building"
+	StatusStarting  DeploymentStatus = "starting"
+	StatusHealthy   DeploymentStatus = "healthy"
 	StatusFailed    DeploymentStatus = "failed"
+	StatusCancelled DeploymentStatus = "cancelled"
 )
 
 type DeploymentState struct {
-	Status    DeploymentStatus `json:"status"`
-	StartTime time.Time        `json:"start_time"`
-	Message   string           `json:"message"`
+	Status        DeploymentStatus `json:"status"`
+	ReleaseID     string           `json:"release_id"`
+	StartTime     time.Time        `json:"start_time"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	Message       string           `json:"message"`
+	QueuePosition int              `json:"queue_position,omitempty"`
 }
 
-type DeploymentStateManager struct {
-	States map[string]*DeploymentState `json:"deployments"`
-	mutex  sync.RWMutex
+type ReleaseTrigger string
+
+const (
+	TriggerAPI      ReleaseTrigger = "api"
+	TriggerWebhook  ReleaseTrigger = "webhook"
+	TriggerRedeploy ReleaseTrigger = "redeploy"
+	TriggerRollback ReleaseTrigger = "rollback"
+	// TriggerEnv releases restart the current image with changed env vars.
+	TriggerEnv ReleaseTrigger = "env"
+)
+
+type ReleaseStatus string
+
+const (
+	ReleaseRunning   ReleaseStatus = "running"
+	ReleaseSucceeded ReleaseStatus = "succeeded"
+	ReleaseFailed    ReleaseStatus = "failed"
+	ReleaseCancelled ReleaseStatus = "cancelled"
+)
+
+// steps of the deploy pipeline, recorded on a release when it fails.
+const (
+	StepEnv              = "env"
+	StepClone            = "clone"
+	StepServiceDiscovery = "service_discovery"
+	StepDockerFile       = "dockerfile"
+	StepBuild            = "build"
+	StepContainer        = "container"
+	StepHealthCheck      = "healthcheck"
+	StepStatus           = "status"
+	StepTimeout          = "timeout"
+	StepRestart          = "restart"
+	StepRelease          = "release"
+)
+
+type Release struct {
+	ID           string         `json:"id"`
+	DeploymentID string         `json:"deployment_id"`
+	CommitSHA    string         `json:"commit_sha"`
+	Trigger      ReleaseTrigger `json:"trigger"`
+	ImageTag     string         `json:"image_tag"`
+	Status       ReleaseStatus  `json:"status"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   *time.Time     `json:"finished_at"`
+	FailedStep   string         `json:"failed_step"`
+	// FailureReason is the error the failed step ended with.
+	FailureReason string `json:"failure_reason"`
+}
+
+// StepTimeouts bound how long the steps of the deploy pipeline may take.
+type StepTimeouts struct {
+	Clone time.Duration
+	Build time.Duration
+	// Start covers creating the container and waiting for it to pass its health check.
+	Start time.Duration
+}
+
+type EventStatus string
+
+const (
+	EventSuccess EventStatus = "success"
+	EventError   EventStatus = "error"
+)
+
+// DeployEvent reports the outcome of a step of the deploy pipeline to clients.
+// The ID is assigned when the event is broadcast.
+type DeployEvent struct {
+	ID           uint64      `json:"id"`
+	DeploymentID string      `json:"deployment_id"`
+	SubDomain    string      `json:"subdomain"`
+	Step         string      `json:"step"`
+	Status       EventStatus `json:"status"`
+	Message      string      `json:"message"`
+	Timestamp    time.Time   `json:"timestamp"`
 }
 
 type DockerTemplateData struct {
@@ -38,6 +114,49 @@ type DockerTemplateData struct {
 	EnvVars        []EnvVar
 }
 
+type DeliveryStatus string
+
+const (
+	// DeliveryQueued deliveries queued a deploy of their deployment.
+	DeliveryQueued DeliveryStatus = "queued"
+	// DeliveryTeardown deliveries closed a pull request and removed its preview.
+	DeliveryTeardown DeliveryStatus = "teardown"
+	// DeliveryIgnored deliveries were verified but were no push or pull
+	// request for a branch the deployment follows.
+	DeliveryIgnored DeliveryStatus = "ignored"
+	// DeliveryRejected deliveries failed the signature check.
+	DeliveryRejected DeliveryStatus = "rejected"
+	// DeliveryInvalid deliveries could not be read or matched no deployment.
+	DeliveryInvalid DeliveryStatus = "invalid"
+)
+
+// WebhookDelivery is a webhook request as it was received, with what came of
+// it. A request for several deployments is stored once per deployment.
+type WebhookDelivery struct {
+	ID             string              `json:"id"`
+	DeploymentID   string              `json:"deployment_id"`
+	Provider       string              `json:"provider"`
+	Headers        map[string][]string `json:"headers"`
+	Body           string              `json:"body"`
+	SignatureValid bool                `json:"signature_valid"`
+	Status         DeliveryStatus      `json:"status"`
+	Error          string              `json:"error"`
+	ReleaseID      string              `json:"release_id"`
+	ReplayOf       string              `json:"replay_of"`
+	ReceivedAt     time.Time           `json:"received_at"`
+}
+
+// Checkout is the revision of the repository a deploy builds. The zero value
+// builds the tip of the deployment's branch. Branch can also be a full ref
+// such as refs/pull/42/head.
+type Checkout struct {
+	Branch    string
+	CommitSHA string
+	// Ref pins the deploy to a commit SHA, tag or branch, it is checked out
+	// detached and takes precedence over Branch and CommitSHA.
+	Ref string
+}
+
 type Deployment struct {
 	ID          string
 	SubDomain   string
@@ -48,11 +167,55 @@ type Deployment struct {
 	ProjectType int
 	EnvVars     []EnvVar
 	Port        int
+	HealthCheck HealthCheck
+	// WebhookSecret signs the webhooks of the repository, it is only handed
+	// out on creation and rotation.
+	WebhookSecret string `json:"-"`
+	// ParentID and PRNumber are set on preview deployments of pull requests.
+	ParentID string
+	PRNumber int
+	// RootDir is the directory of the repository that is built, for
+	// repositories with several apps. DockerfilePath is relative to it and
+	// replaces the generated Dockerfile.
+	RootDir        string
+	DockerfilePath string
+}
+
+// HealthCheck describes the http probe a new container has to pass before it
+// takes over traffic. It runs inside the container as a docker health check,
+// so the image needs a shell with curl or wget. An empty Path only waits for
+// the port to accept connections.
+type HealthCheck struct {
+	Path           string `json:"path"`
+	ExpectedStatus int    `json:"expected_status"`
+	Timeout        int    `json:"timeout"`
+	Retries        int    `json:"retries"`
 }
 
 type EnvVar struct {
 	Key   string
 	Value string
+	// BuildTime vars are baked into the image for steps like `npm run build`,
+	// all vars are passed to the container at runtime.
+	BuildTime bool
+	// Secret values can be written but are masked whenever they are read
+	// back, in responses and build logs.
+	Secret bool
+	// sealed, dataKey and keyID are the encrypted value as it is stored.
+	sealed  []byte
+	dataKey []byte
+	keyID   string
+}
+
+// EnvGroup is a set of env vars a user shares between deployments. A
+// deployment applies its groups in order, each overriding the ones before,
+// and its own vars override all of them.
+type EnvGroup struct {
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"owner_id"`
+	Name      string    `json:"name"`
+	EnvVars   []EnvVar  `json:"envs"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type ContainerStats struct {
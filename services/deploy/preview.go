@@ -0,0 +1,145 @@
+package deploy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// previewTeardownWait is how long a teardown waits for a running deploy of
+// the preview to stop after cancelling it.
+const previewTeardownWait = time.Minute
+
+func constructPreviewSubDomain(parent *Deployment, prNumber int) string {
+	return fmt.Sprintf("pr-%d-%s", prNumber, parent.SubDomain)
+}
+
+// GetPreviewDeployment returns the preview deployment of the pull request, or
+// nil if there is none.
+func (d *DeployService) GetPreviewDeployment(parent *Deployment, prNumber int) (*Deployment, error) {
+	dep, err := d.repo.GetPreviewDeployment(parent.ID, prNumber)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.openEnvVars(dep)
+	if err != nil {
+		return nil, err
+	}
+
+	return dep, nil
+}
+
+// NewPreviewDeployment creates the deployment of a pull request against the
+// parent's branch. It builds the given ref and starts out with the parent's
+// settings, env vars and env groups.
+func (d *DeployService) NewPreviewDeployment(parent *Deployment, prNumber int, ref string) (*Deployment, error) {
+	envVars := make([]EnvVar, len(parent.EnvVars))
+	copy(envVars, parent.EnvVars)
+
+	preview, err := d.NewDeployment(&Deployment{
+		SubDomain:      constructPreviewSubDomain(parent, prNumber),
+		CloneUrl:       parent.CloneUrl,
+		Branch:         ref,
+		RepoName:       parent.RepoName,
+		EnvVars:        envVars,
+		Port:           parent.Port,
+		HealthCheck:    parent.HealthCheck,
+		ParentID:       parent.ID,
+		PRNumber:       prNumber,
+		RootDir:        parent.RootDir,
+		DockerfilePath: parent.DockerfilePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.copyGitCredential(parent, preview)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.copyEnvGroups(parent, preview)
+	if err != nil {
+		return nil, err
+	}
+
+	return preview, nil
+}
+
+// DeletePreviewDeployment stops what is building for the preview and removes
+// its containers, images, project directory and the deployment itself.
+func (d *DeployService) DeletePreviewDeployment(preview *Deployment, dockerCli *client.Client) error {
+	if preview.ParentID == "" {
+		return errors.New("not a preview deployment")
+	}
+
+	d.CancelDeploy(preview.ID)
+
+	deadline := time.Now().Add(previewTeardownWait)
+	for {
+		if _, ok := d.queue.acquire(preview.ID); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("deploy of the preview did not stop")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	defer d.queue.release(preview.ID)
+
+	ctx := context.Background()
+
+	containers, err := d.listDeploymentContainers(ctx, preview, dockerCli)
+	if err != nil {
+		return err
+	}
+	for _, id := range containers {
+		err := dockerCli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+
+	images, err := dockerCli.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", fmt.Sprintf("%v-image", preview.ID))),
+	})
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		_, err := dockerCli.ImageRemove(ctx, img.ID, image.RemoveOptions{Force: true, PruneChildren: true})
+		if err != nil && !errdefs.IsNotFound(err) {
+			log.Println("{SERVER}: Failed to remove image of preview:", err.Error())
+		}
+	}
+
+	err = os.RemoveAll(preview.ProjectPath)
+	if err != nil {
+		return err
+	}
+
+	err = d.repo.deleteDeployment(preview.ID)
+	if err != nil {
+		fmt.Println("ERROR WHILE DELETING DEPLOYMENT")
+		fmt.Println(err)
+		return err
+	}
+
+	fmt.Printf("{SERVER}: removed preview deployment %s\n", preview.SubDomain)
+	return nil
+}
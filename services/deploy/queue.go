@@ -0,0 +1,257 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// DeployJob is a request to run the deploy pipeline for a deployment.
+type DeployJob struct {
+	Deployment *Deployment
+	Redeploy   bool
+	Trigger    ReleaseTrigger
+	// Checkout is the pushed branch and commit for webhook jobs.
+	Checkout Checkout
+	// DeliveryIDs are the webhook deliveries that asked for the job.
+	DeliveryIDs []string
+	// Owner is the user the deployment belongs to, used to share the
+	// workers fairly between users.
+	Owner    string
+	QueuedAt time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// BuildQueue runs deploy jobs on a fixed number of workers. Jobs for the same
+// deployment never run at the same time, and a job queued for a deployment that
+// already has one waiting replaces it instead of adding a second build.
+type BuildQueue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	jobs    []*DeployJob
+	running map[string]bool
+	// cancel functions of the jobs the workers are running
+	cancels map[string]context.CancelFunc
+	// number of running jobs per owner
+	owners map[string]int
+}
+
+func newBuildQueue() *BuildQueue {
+	q := &BuildQueue{
+		running: make(map[string]bool),
+		cancels: make(map[string]context.CancelFunc),
+		owners:  make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push adds the job to the end of the queue, or replaces the job that is
+// already waiting for the same deployment while keeping its place in line.
+func (q *BuildQueue) push(job *DeployJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, queued := range q.jobs {
+		if queued.Deployment.ID == job.Deployment.ID {
+			job.Redeploy = job.Redeploy || queued.Redeploy
+			job.DeliveryIDs = append(queued.DeliveryIDs, job.DeliveryIDs...)
+			job.QueuedAt = queued.QueuedAt
+			q.jobs[i] = job
+			return
+		}
+	}
+
+	q.jobs = append(q.jobs, job)
+	q.cond.Signal()
+}
+
+// next blocks until a job can run. Jobs of deployments that are already
+// building are skipped, and among the rest the owner with the fewest running
+// builds goes first, in FIFO order between equals.
+func (q *BuildQueue) next() *DeployJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		pick := -1
+		for i, job := range q.jobs {
+			if q.running[job.Deployment.ID] {
+				continue
+			}
+			if pick == -1 || q.owners[job.Owner] < q.owners[q.jobs[pick].Owner] {
+				pick = i
+			}
+		}
+
+		if pick != -1 {
+			job := q.jobs[pick]
+			q.jobs = append(q.jobs[:pick], q.jobs[pick+1:]...)
+			job.ctx, job.cancel = context.WithCancel(context.Background())
+			q.cancels[job.Deployment.ID] = job.cancel
+			q.running[job.Deployment.ID] = true
+			q.owners[job.Owner]++
+			return job
+		}
+
+		q.cond.Wait()
+	}
+}
+
+func (q *BuildQueue) done(job *DeployJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job.cancel()
+	delete(q.cancels, job.Deployment.ID)
+	delete(q.running, job.Deployment.ID)
+	q.owners[job.Owner]--
+	if q.owners[job.Owner] <= 0 {
+		delete(q.owners, job.Owner)
+	}
+	q.cond.Broadcast()
+}
+
+// remove drops the job waiting for the deployment, if there is one.
+func (q *BuildQueue) remove(deploymentId string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, job := range q.jobs {
+		if job.Deployment.ID == deploymentId {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// cancel stops the job a worker is running for the deployment, if there is one.
+func (q *BuildQueue) cancel(deploymentId string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	cancel, ok := q.cancels[deploymentId]
+	if ok {
+		cancel()
+	}
+
+	return ok
+}
+
+// acquire marks the deployment as busy outside of the workers, e.g. for a
+// rollback, so no queued job for it starts in the meantime. The returned
+// context is cancelled by CancelDeploy and once the deployment is released.
+func (q *BuildQueue) acquire(deploymentId string) (context.Context, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.running[deploymentId] {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancels[deploymentId] = cancel
+	q.running[deploymentId] = true
+	return ctx, true
+}
+
+func (q *BuildQueue) release(deploymentId string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if cancel, ok := q.cancels[deploymentId]; ok {
+		cancel()
+		delete(q.cancels, deploymentId)
+	}
+	delete(q.running, deploymentId)
+	q.cond.Broadcast()
+}
+
+// status returns the 1-based place of the deployment in the queue (0 if it
+// has nothing waiting), when it was queued and whether it is running right now.
+func (q *BuildQueue) status(deploymentId string) (int, time.Time, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, job := range q.jobs {
+		if job.Deployment.ID == deploymentId {
+			return i + 1, job.QueuedAt, q.running[deploymentId]
+		}
+	}
+
+	return 0, time.Time{}, q.running[deploymentId]
+}
+
+// StartBuildQueue starts the workers that run queued deploy jobs.
+func (d *DeployService) StartBuildQueue(workers int, dockerCli *client.Client, events chan DeployEvent) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	cleanBuildDirs()
+	d.failInterruptedDeploys()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				job := d.queue.next()
+				d.runJob(job, dockerCli, events)
+				d.queue.done(job)
+			}
+		}()
+	}
+
+	fmt.Printf("{SERVER}: started build queue with %d workers\n", workers)
+}
+
+func (d *DeployService) runJob(job *DeployJob, dockerCli *client.Client, events chan DeployEvent) {
+	// a job that was queued while the previous one was still running finds
+	// the deployment in that one's final state.
+	d.dsmTransition(job.Deployment.ID, StatusQueued, "", "Queued..")
+
+	err := d.Deploy(job.ctx, job, dockerCli, events)
+	if err != nil {
+		log.Printf("{SERVER}: deploy of %s ended with: %v\n", job.Deployment.ID, err)
+	}
+}
+
+// EnqueueDeploy queues the job and returns its place in the queue.
+func (d *DeployService) EnqueueDeploy(job *DeployJob) int {
+	// this fails while an earlier job of the deployment still runs, runJob
+	// queues it once that one finished.
+	d.dsmTransition(job.Deployment.ID, StatusQueued, "", "Queued..")
+
+	job.QueuedAt = time.Now()
+	d.queue.push(job)
+
+	position, _, _ := d.queue.status(job.Deployment.ID)
+	return position
+}
+
+// CancelDeploy drops the queued job of the deployment and stops the one that
+// is running, including rollbacks and restarts. It fails if there was nothing
+// to cancel.
+func (d *DeployService) CancelDeploy(deploymentId string) error {
+	removed := d.queue.remove(deploymentId)
+	cancelled := d.queue.cancel(deploymentId)
+
+	if !removed && !cancelled {
+		return errors.New("no queued or running deployment to cancel")
+	}
+
+	// a running deploy records its cancellation itself once it stops.
+	if !cancelled {
+		d.dsmTransition(deploymentId, StatusCancelled, "", "deployment cancelled")
+	}
+
+	return nil
+}
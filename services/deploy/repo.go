@@ -1,9 +1,16 @@
 package deploy
 
-import "fmt"
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
 
 func (r *DeployServiceRepo) addDeployment(deployment *Deployment) error {
-	_, err := r.db.Exec("INSERT INTO deployments (id, subdomain, clone_url, branch, repo_name, project_type, port, project_path) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", deployment.ID, deployment.SubDomain, deployment.CloneUrl, deployment.Branch, deployment.RepoName, deployment.ProjectType, deployment.Port, deployment.ProjectPath)
+	_, err := r.db.Exec("INSERT INTO deployments (id, subdomain, clone_url, branch, repo_name, project_type, port, project_path, health_check_path, health_check_status, health_check_timeout, health_check_retries, webhook_secret, parent_id, pr_number, root_dir, dockerfile_path) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, ''), $15, $16, $17)", deployment.ID, deployment.SubDomain, deployment.CloneUrl, deployment.Branch, deployment.RepoName, deployment.ProjectType, deployment.Port, deployment.ProjectPath, deployment.HealthCheck.Path, deployment.HealthCheck.ExpectedStatus, deployment.HealthCheck.Timeout, deployment.HealthCheck.Retries, deployment.WebhookSecret, deployment.ParentID, deployment.PRNumber, deployment.RootDir, deployment.DockerfilePath)
 
 	if err != nil {
 		return err
@@ -12,6 +19,17 @@ func (r *DeployServiceRepo) addDeployment(deployment *Deployment) error {
 	return nil
 }
 
+func (r *DeployServiceRepo) updateHealthCheck(deployment *Deployment) error {
+	_, err := r.db.Exec("UPDATE deployments SET health_check_path = $1, health_check_status = $2, health_check_timeout = $3, health_check_retries = $4 WHERE id = $5",
+		deployment.HealthCheck.Path, deployment.HealthCheck.ExpectedStatus, deployment.HealthCheck.Timeout, deployment.HealthCheck.Retries, deployment.ID)
+	return err
+}
+
+func (r *DeployServiceRepo) updateWebhookSecret(deployment *Deployment) error {
+	_, err := r.db.Exec("UPDATE deployments SET webhook_secret = $1 WHERE id = $2", deployment.WebhookSecret, deployment.ID)
+	return err
+}
+
 func (r *DeployServiceRepo) addEnvVars(deployment *Deployment, envs []EnvVar) error {
 	tx, err := r.db.Begin()
 	if err != nil {
@@ -24,7 +42,7 @@ func (r *DeployServiceRepo) addEnvVars(deployment *Deployment, envs []EnvVar) er
 		}
 	}()
 
-	stmt, err := tx.Prepare("INSERT INTO env_vars (deployment_id, key, value) VALUES ($1, $2, $3)")
+	stmt, err := tx.Prepare("INSERT INTO env_vars (deployment_id, key, value, build_time, secret, sealed_value, data_key, key_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
 	if err != nil {
 		return err
 	}
@@ -32,7 +50,47 @@ func (r *DeployServiceRepo) addEnvVars(deployment *Deployment, envs []EnvVar) er
 
 	for _, env := range envs {
 		fmt.Println(env.Key)
-		if _, err := stmt.Exec(deployment.ID, env.Key, env.Value); err != nil {
+		if _, err = stmt.Exec(deployment.ID, env.Key, env.Value, env.BuildTime, env.Secret, env.sealed, env.dataKey, env.keyID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// upsertEnvVars inserts or updates the env vars in one transaction. With
+// replace, the other vars of the deployment are deleted.
+func (r *DeployServiceRepo) upsertEnvVars(deployment *Deployment, envs []EnvVar, replace bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.Prepare(`INSERT INTO env_vars (deployment_id, key, value, build_time, secret, sealed_value, data_key, key_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (deployment_id, key) DO UPDATE SET value = EXCLUDED.value, build_time = EXCLUDED.build_time, secret = EXCLUDED.secret,
+        sealed_value = EXCLUDED.sealed_value, data_key = EXCLUDED.data_key, key_id = EXCLUDED.key_id`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	keys := make([]string, 0, len(envs))
+	for _, env := range envs {
+		if _, err = stmt.Exec(deployment.ID, env.Key, env.Value, env.BuildTime, env.Secret, env.sealed, env.dataKey, env.keyID); err != nil {
+			return err
+		}
+		keys = append(keys, env.Key)
+	}
+
+	if replace {
+		_, err = tx.Exec("DELETE FROM env_vars WHERE deployment_id = $1 AND NOT (key = ANY($2))", deployment.ID, pq.Array(keys))
+		if err != nil {
 			return err
 		}
 	}
@@ -41,8 +99,8 @@ func (r *DeployServiceRepo) addEnvVars(deployment *Deployment, envs []EnvVar) er
 }
 
 func (r *DeployServiceRepo) updateEnvVar(deployment *Deployment, env EnvVar, newEnv EnvVar) error {
-	_, err := r.db.Exec("UPDATE env_vars SET value = $1 WHERE deployment_id = $2 AND key = $3",
-		newEnv.Value, deployment.ID, env.Key)
+	_, err := r.db.Exec("UPDATE env_vars SET value = $1, build_time = $2, secret = $3, sealed_value = $4, data_key = $5, key_id = $6 WHERE deployment_id = $7 AND key = $8",
+		newEnv.Value, newEnv.BuildTime, newEnv.Secret, newEnv.sealed, newEnv.dataKey, newEnv.keyID, deployment.ID, env.Key)
 	return err
 }
 
@@ -52,16 +110,38 @@ func (r *DeployServiceRepo) deleteEnvVar(deployment *Deployment, env EnvVar) err
 	return err
 }
 
+const envVarColumns = `key, COALESCE(value, ''), build_time, secret, sealed_value, data_key, key_id`
+
+func scanEnvVar(row interface{ Scan(...any) error }, env *EnvVar) error {
+	return row.Scan(&env.Key, &env.Value, &env.BuildTime, &env.Secret, &env.sealed, &env.dataKey, &env.keyID)
+}
+
 func (r *DeployServiceRepo) getEnv(deployment *Deployment, env *EnvVar) error {
-	var value string
-	err := r.db.QueryRow("SELECT value FROM env_vars WHERE deployment_id = $1 AND key = $2",
-		deployment.ID, env.Key).Scan(&value)
+	return scanEnvVar(r.db.QueryRow("SELECT "+envVarColumns+" FROM env_vars WHERE deployment_id = $1 AND key = $2",
+		deployment.ID, env.Key), env)
+}
+
+// getEnvVarsNotSealedWith returns the env vars per deployment that are stored
+// in plain or wrapped with another key than keyID.
+func (r *DeployServiceRepo) getEnvVarsNotSealedWith(keyID string) (map[string][]EnvVar, error) {
+	rows, err := r.db.Query("SELECT deployment_id, "+envVarColumns+" FROM env_vars WHERE key_id <> $1", keyID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	env.Value = value
-	return nil
+	envVars := make(map[string][]EnvVar)
+	for rows.Next() {
+		var deploymentId string
+		var ev EnvVar
+		err := rows.Scan(&deploymentId, &ev.Key, &ev.Value, &ev.BuildTime, &ev.Secret, &ev.sealed, &ev.dataKey, &ev.keyID)
+		if err != nil {
+			return nil, err
+		}
+		envVars[deploymentId] = append(envVars[deploymentId], ev)
+	}
+
+	return envVars, rows.Err()
 }
 
 func (r *DeployServiceRepo) findDeploymentBasedOnSubdomain(subDomain string) error {
@@ -84,9 +164,10 @@ func (r *DeployServiceRepo) findDeploymentBasedOnCloneUrl(CloneUrl string) error
 
 func (r *DeployServiceRepo) GetEnvVarsForDeployment(deploymentID string) ([]EnvVar, error) {
 	envVarQuery := `
-        SELECT key, value 
+        SELECT ` + envVarColumns + `
         FROM env_vars 
-        WHERE deployment_id = $1`
+        WHERE deployment_id = $1
+        ORDER BY key`
 	rows, err := r.db.Query(envVarQuery, deploymentID)
 	if err != nil {
 		return nil, err
@@ -96,7 +177,7 @@ func (r *DeployServiceRepo) GetEnvVarsForDeployment(deploymentID string) ([]EnvV
 	var envVars []EnvVar
 	for rows.Next() {
 		var ev EnvVar
-		if err := rows.Scan(&ev.Key, &ev.Value); err != nil {
+		if err := scanEnvVar(rows, &ev); err != nil {
 			continue
 		}
 		envVars = append(envVars, ev)
@@ -108,13 +189,11 @@ func (r *DeployServiceRepo) GetEnvVarsForDeployment(deploymentID string) ([]EnvV
 	return envVars, nil
 }
 
-func (r *DeployServiceRepo) GetDeploymentBasedOnCloneUrl(cloneUrl string) (*Deployment, error) {
-	deploymentQuery := `
-        SELECT id, subdomain, clone_url, branch, repo_name, project_path, project_type, port 
-        FROM deployments 
-        WHERE clone_url = $1`
-	row := r.db.QueryRow(deploymentQuery, cloneUrl)
+const deploymentColumns = `id, subdomain, clone_url, branch, repo_name, project_path, project_type, port,
+        health_check_path, health_check_status, health_check_timeout, health_check_retries, webhook_secret,
+        COALESCE(parent_id, ''), pr_number, root_dir, dockerfile_path`
 
+func (r *DeployServiceRepo) scanDeployment(row interface{ Scan(...any) error }) (*Deployment, error) {
 	var dep Deployment
 	err := row.Scan(
 		&dep.ID,
@@ -125,6 +204,15 @@ func (r *DeployServiceRepo) GetDeploymentBasedOnCloneUrl(cloneUrl string) (*Depl
 		&dep.ProjectPath,
 		&dep.ProjectType,
 		&dep.Port,
+		&dep.HealthCheck.Path,
+		&dep.HealthCheck.ExpectedStatus,
+		&dep.HealthCheck.Timeout,
+		&dep.HealthCheck.Retries,
+		&dep.WebhookSecret,
+		&dep.ParentID,
+		&dep.PRNumber,
+		&dep.RootDir,
+		&dep.DockerfilePath,
 	)
 	if err != nil {
 		return nil, err
@@ -139,33 +227,599 @@ func (r *DeployServiceRepo) GetDeploymentBasedOnCloneUrl(cloneUrl string) (*Depl
 	return &dep, nil
 }
 
+func (r *DeployServiceRepo) GetDeploymentsBasedOnCloneUrls(cloneUrls []string) ([]*Deployment, error) {
+	deploymentQuery := `
+        SELECT ` + deploymentColumns + `
+        FROM deployments 
+        WHERE clone_url = ANY($1)`
+
+	rows, err := r.db.Query(deploymentQuery, pq.Array(cloneUrls))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deployments := make([]*Deployment, 0)
+	for rows.Next() {
+		dep, err := r.scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, dep)
+	}
+
+	return deployments, rows.Err()
+}
+
 func (r *DeployServiceRepo) GetDeploymentByID(id string) (*Deployment, error) {
 	deploymentQuery := `
-        SELECT id, subdomain, clone_url, branch, repo_name, project_path, project_type, port 
+        SELECT ` + deploymentColumns + `
         FROM deployments 
         WHERE id = $1`
-	row := r.db.QueryRow(deploymentQuery, id)
 
-	var dep Deployment
+	return r.scanDeployment(r.db.QueryRow(deploymentQuery, id))
+}
+
+func (r *DeployServiceRepo) GetPreviewDeployment(parentID string, prNumber int) (*Deployment, error) {
+	deploymentQuery := `
+        SELECT ` + deploymentColumns + `
+        FROM deployments 
+        WHERE parent_id = $1 AND pr_number = $2`
+
+	return r.scanDeployment(r.db.QueryRow(deploymentQuery, parentID, prNumber))
+}
+
+func (r *DeployServiceRepo) deleteDeployment(id string) error {
+	_, err := r.db.Exec("DELETE FROM deployments WHERE id = $1", id)
+	return err
+}
+
+func (r *DeployServiceRepo) addRelease(release *Release) error {
+	_, err := r.db.Exec("INSERT INTO releases (id, deployment_id, commit_sha, triggered_by, image_tag, status, started_at, failed_step) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		release.ID, release.DeploymentID, release.CommitSHA, release.Trigger, release.ImageTag, release.Status, release.StartedAt, release.FailedStep)
+	return err
+}
+
+func (r *DeployServiceRepo) updateRelease(release *Release) error {
+	_, err := r.db.Exec("UPDATE releases SET commit_sha = $1, image_tag = $2, status = $3, finished_at = $4, failed_step = $5, failure_reason = $6 WHERE id = $7",
+		release.CommitSHA, release.ImageTag, release.Status, release.FinishedAt, release.FailedStep, release.FailureReason, release.ID)
+	return err
+}
+
+// failStaleReleases fails the releases that are still running although they
+// started before the cutoff and returns how many there were.
+func (r *DeployServiceRepo) failStaleReleases(cutoff time.Time, step string, reason string) (int64, error) {
+	res, err := r.db.Exec("UPDATE releases SET status = $1, finished_at = now(), failed_step = $2, failure_reason = $3 WHERE status = $4 AND started_at < $5",
+		ReleaseFailed, step, reason, ReleaseRunning, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func scanRelease(row interface{ Scan(...any) error }) (*Release, error) {
+	var release Release
+	var commitSha, imageTag, failedStep, failureReason sql.NullString
+	var finishedAt sql.NullTime
+
 	err := row.Scan(
-		&dep.ID,
-		&dep.SubDomain,
-		&dep.CloneUrl,
-		&dep.Branch,
-		&dep.RepoName,
-		&dep.ProjectPath,
-		&dep.ProjectType,
-		&dep.Port,
+		&release.ID,
+		&release.DeploymentID,
+		&commitSha,
+		&release.Trigger,
+		&imageTag,
+		&release.Status,
+		&release.StartedAt,
+		&finishedAt,
+		&failedStep,
+		&failureReason,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	envVars, err := r.GetEnvVarsForDeployment(dep.ID)
+	release.CommitSHA = commitSha.String
+	release.ImageTag = imageTag.String
+	release.FailedStep = failedStep.String
+	release.FailureReason = failureReason.String
+	if finishedAt.Valid {
+		release.FinishedAt = &finishedAt.Time
+	}
+
+	return &release, nil
+}
+
+func (r *DeployServiceRepo) getReleaseByID(id string) (*Release, error) {
+	releaseQuery := `
+        SELECT id, deployment_id, commit_sha, triggered_by, image_tag, status, started_at, finished_at, failed_step, failure_reason
+        FROM releases
+        WHERE id = $1`
+
+	return scanRelease(r.db.QueryRow(releaseQuery, id))
+}
+
+func (r *DeployServiceRepo) getReleasesForDeployment(deploymentID string) ([]*Release, error) {
+	releaseQuery := `
+        SELECT id, deployment_id, commit_sha, triggered_by, image_tag, status, started_at, finished_at, failed_step, failure_reason
+        FROM releases
+        WHERE deployment_id = $1
+        ORDER BY started_at DESC`
+	rows, err := r.db.Query(releaseQuery, deploymentID)
 	if err != nil {
-		return &dep, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	dep.EnvVars = envVars
-	return &dep, nil
+	releases := make([]*Release, 0)
+	for rows.Next() {
+		release, err := scanRelease(rows)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+func (r *DeployServiceRepo) getLatestReleaseForDeployment(deploymentID string) (*Release, error) {
+	releaseQuery := `
+        SELECT id, deployment_id, commit_sha, triggered_by, image_tag, status, started_at, finished_at, failed_step, failure_reason
+        FROM releases
+        WHERE deployment_id = $1
+        ORDER BY started_at DESC
+        LIMIT 1`
+
+	return scanRelease(r.db.QueryRow(releaseQuery, deploymentID))
+}
+
+func (r *DeployServiceRepo) updateReleaseBuildLog(releaseID string, buildLog string) error {
+	_, err := r.db.Exec("UPDATE releases SET build_log = $1 WHERE id = $2", buildLog, releaseID)
+	return err
+}
+
+func (r *DeployServiceRepo) getReleaseBuildLog(releaseID string) (string, error) {
+	var buildLog sql.NullString
+	err := r.db.QueryRow("SELECT build_log FROM releases WHERE id = $1", releaseID).Scan(&buildLog)
+	if err != nil {
+		return "", err
+	}
+
+	return buildLog.String, nil
+}
+
+// transitionState moves the deployment to the given state if it currently is in
+// one of the from states. Queueing also creates the state of a deployment that
+// has none yet. It reports whether the transition happened.
+func (r *DeployServiceRepo) transitionState(deploymentID string, to DeploymentStatus, from []string, releaseID string, message string) (bool, error) {
+	var res sql.Result
+	var err error
+
+	if to == StatusQueued {
+		res, err = r.db.Exec(`
+        INSERT INTO deployment_states (deployment_id, status, release_id, message, started_at, updated_at)
+        VALUES ($1, $2, NULLIF($3, ''), $4, now(), now())
+        ON CONFLICT (deployment_id) DO UPDATE
+        SET status = EXCLUDED.status, release_id = EXCLUDED.release_id, message = EXCLUDED.message,
+            started_at = EXCLUDED.started_at, updated_at = EXCLUDED.updated_at
+        WHERE deployment_states.status = ANY($5)`,
+			deploymentID, to, releaseID, message, pq.Array(from))
+	} else {
+		res, err = r.db.Exec(`
+        UPDATE deployment_states
+        SET status = $2, release_id = COALESCE(NULLIF($3, ''), release_id), message = $4, updated_at = now()
+        WHERE deployment_id = $1 AND status = ANY($5)`,
+			deploymentID, to, releaseID, message, pq.Array(from))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (r *DeployServiceRepo) getState(deploymentID string) (*DeploymentState, error) {
+	var state DeploymentState
+	var releaseID sql.NullString
+
+	err := r.db.QueryRow("SELECT status, release_id, message, started_at, updated_at FROM deployment_states WHERE deployment_id = $1", deploymentID).
+		Scan(&state.Status, &releaseID, &state.Message, &state.StartTime, &state.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	state.ReleaseID = releaseID.String
+	return &state, nil
+}
+
+func (r *DeployServiceRepo) getStatesWithStatus(statuses []DeploymentStatus) (map[string]*DeploymentState, error) {
+	rows, err := r.db.Query("SELECT deployment_id, status, release_id, message, started_at, updated_at FROM deployment_states WHERE status = ANY($1)", pq.Array(statusStrings(statuses)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]*DeploymentState)
+	for rows.Next() {
+		var id string
+		var state DeploymentState
+		var releaseID sql.NullString
+		if err := rows.Scan(&id, &state.Status, &releaseID, &state.Message, &state.StartTime, &state.UpdatedAt); err != nil {
+			return nil, err
+		}
+		state.ReleaseID = releaseID.String
+		states[id] = &state
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// failStaleStates fails the deployments in one of the given states that
+// haven't moved since the cutoff and returns their ids.
+func (r *DeployServiceRepo) failStaleStates(statuses []DeploymentStatus, cutoff time.Time, reason string) ([]string, error) {
+	rows, err := r.db.Query("UPDATE deployment_states SET status = $1, message = $2, updated_at = now() WHERE status = ANY($3) AND updated_at < $4 RETURNING deployment_id",
+		StatusFailed, reason, pq.Array(statusStrings(statuses)), cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func statusStrings(statuses []DeploymentStatus) []string {
+	result := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		result = append(result, string(status))
+	}
+	return result
+}
+
+func (r *DeployServiceRepo) addWebhookDelivery(delivery *WebhookDelivery) error {
+	headers, err := json.Marshal(delivery.Headers)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(`INSERT INTO webhook_deliveries (id, deployment_id, provider, headers, body, signature_valid, status, error, replay_of, received_at)
+        VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10)`,
+		delivery.ID, delivery.DeploymentID, delivery.Provider, headers, []byte(delivery.Body), delivery.SignatureValid,
+		delivery.Status, delivery.Error, delivery.ReplayOf, delivery.ReceivedAt)
+	return err
+}
+
+func (r *DeployServiceRepo) setDeliveriesRelease(deliveryIDs []string, releaseID string) error {
+	_, err := r.db.Exec("UPDATE webhook_deliveries SET release_id = $1 WHERE id = ANY($2)", releaseID, pq.Array(deliveryIDs))
+	return err
+}
+
+const webhookDeliveryColumns = `id, COALESCE(deployment_id, ''), provider, headers, body, signature_valid, status, error,
+        COALESCE(release_id, ''), COALESCE(replay_of, ''), received_at`
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var headers, body []byte
+
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.DeploymentID,
+		&delivery.Provider,
+		&headers,
+		&body,
+		&delivery.SignatureValid,
+		&delivery.Status,
+		&delivery.Error,
+		&delivery.ReleaseID,
+		&delivery.ReplayOf,
+		&delivery.ReceivedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Body = string(body)
+	if err := json.Unmarshal(headers, &delivery.Headers); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func (r *DeployServiceRepo) getWebhookDelivery(id string) (*WebhookDelivery, error) {
+	deliveryQuery := `
+        SELECT ` + webhookDeliveryColumns + `
+        FROM webhook_deliveries
+        WHERE id = $1`
+
+	return scanWebhookDelivery(r.db.QueryRow(deliveryQuery, id))
+}
+
+func (r *DeployServiceRepo) getWebhookDeliveriesForDeployment(deploymentID string, limit int) ([]*WebhookDelivery, error) {
+	deliveryQuery := `
+        SELECT ` + webhookDeliveryColumns + `
+        FROM webhook_deliveries
+        WHERE deployment_id = $1
+        ORDER BY received_at DESC
+        LIMIT $2`
+	rows, err := r.db.Query(deliveryQuery, deploymentID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+const gitCredentialColumns = "deployment_id, kind, public_key, secret, data_key, key_id, created_at"
+
+func (r *DeployServiceRepo) upsertGitCredential(credential *GitCredential) error {
+	_, err := r.db.Exec(`INSERT INTO git_credentials (`+gitCredentialColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (deployment_id) DO UPDATE SET kind = EXCLUDED.kind, public_key = EXCLUDED.public_key, secret = EXCLUDED.secret,
+        data_key = EXCLUDED.data_key, key_id = EXCLUDED.key_id, created_at = EXCLUDED.created_at`,
+		credential.DeploymentID, credential.Kind, credential.PublicKey, credential.sealed, credential.dataKey, credential.keyID, credential.CreatedAt)
+	return err
+}
+
+func (r *DeployServiceRepo) getGitCredential(deploymentID string) (*GitCredential, error) {
+	var credential GitCredential
+
+	err := r.db.QueryRow("SELECT "+gitCredentialColumns+" FROM git_credentials WHERE deployment_id = $1", deploymentID).
+		Scan(&credential.DeploymentID, &credential.Kind, &credential.PublicKey, &credential.sealed, &credential.dataKey, &credential.keyID, &credential.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &credential, nil
+}
+
+// getGitCredentialsNotSealedWith returns the credentials wrapped with another
+// key than keyID, or sealed with the former CREDENTIALS_KEY.
+func (r *DeployServiceRepo) getGitCredentialsNotSealedWith(keyID string) ([]*GitCredential, error) {
+	rows, err := r.db.Query("SELECT "+gitCredentialColumns+" FROM git_credentials WHERE key_id <> $1", keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := make([]*GitCredential, 0)
+	for rows.Next() {
+		var credential GitCredential
+		err := rows.Scan(&credential.DeploymentID, &credential.Kind, &credential.PublicKey, &credential.sealed, &credential.dataKey, &credential.keyID, &credential.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, &credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (r *DeployServiceRepo) deleteGitCredential(deploymentID string) error {
+	_, err := r.db.Exec("DELETE FROM git_credentials WHERE deployment_id = $1", deploymentID)
+	return err
+}
+
+func (r *DeployServiceRepo) addEnvGroup(group *EnvGroup) error {
+	_, err := r.db.Exec("INSERT INTO env_groups (id, owner_id, name, created_at) VALUES ($1, $2, $3, $4)",
+		group.ID, group.OwnerID, group.Name, group.CreatedAt)
+	return err
+}
+
+func (r *DeployServiceRepo) deleteEnvGroup(id string) error {
+	_, err := r.db.Exec("DELETE FROM env_groups WHERE id = $1", id)
+	return err
+}
+
+func scanEnvGroup(row interface{ Scan(...any) error }) (*EnvGroup, error) {
+	var group EnvGroup
+	err := row.Scan(&group.ID, &group.OwnerID, &group.Name, &group.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (r *DeployServiceRepo) getEnvGroup(id string) (*EnvGroup, error) {
+	return scanEnvGroup(r.db.QueryRow("SELECT id, owner_id, name, created_at FROM env_groups WHERE id = $1", id))
+}
+
+func (r *DeployServiceRepo) queryEnvGroups(query string, args ...any) ([]*EnvGroup, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]*EnvGroup, 0)
+	for rows.Next() {
+		group, err := scanEnvGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+func (r *DeployServiceRepo) getEnvGroupsForOwner(ownerId string) ([]*EnvGroup, error) {
+	return r.queryEnvGroups("SELECT id, owner_id, name, created_at FROM env_groups WHERE owner_id = $1 ORDER BY name", ownerId)
+}
+
+// getDeploymentEnvGroups returns the groups of the deployment in the order
+// they are applied.
+func (r *DeployServiceRepo) getDeploymentEnvGroups(deploymentId string) ([]*EnvGroup, error) {
+	return r.queryEnvGroups(`SELECT g.id, g.owner_id, g.name, g.created_at
+        FROM env_groups g JOIN deployment_env_groups dg ON dg.group_id = g.id
+        WHERE dg.deployment_id = $1
+        ORDER BY dg.position`, deploymentId)
+}
+
+// setDeploymentEnvGroups replaces the groups of the deployment, in the order given.
+func (r *DeployServiceRepo) setDeploymentEnvGroups(deploymentId string, groupIds []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("DELETE FROM deployment_env_groups WHERE deployment_id = $1", deploymentId)
+	if err != nil {
+		return err
+	}
+
+	for i, groupId := range groupIds {
+		_, err = tx.Exec("INSERT INTO deployment_env_groups (deployment_id, group_id, position) VALUES ($1, $2, $3)", deploymentId, groupId, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *DeployServiceRepo) getEnvGroupDeployments(groupId string) ([]string, error) {
+	rows, err := r.db.Query("SELECT deployment_id FROM deployment_env_groups WHERE group_id = $1", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deployments := make([]string, 0)
+	for rows.Next() {
+		var deploymentId string
+		if err := rows.Scan(&deploymentId); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, deploymentId)
+	}
+
+	return deployments, rows.Err()
+}
+
+func (r *DeployServiceRepo) getEnvGroupVars(groupId string) ([]EnvVar, error) {
+	rows, err := r.db.Query("SELECT "+envVarColumns+" FROM env_group_vars WHERE group_id = $1 ORDER BY key", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envVars := make([]EnvVar, 0)
+	for rows.Next() {
+		var ev EnvVar
+		if err := scanEnvVar(rows, &ev); err != nil {
+			return nil, err
+		}
+		envVars = append(envVars, ev)
+	}
+
+	return envVars, rows.Err()
+}
+
+// upsertEnvGroupVars inserts or updates the vars of the group in one
+// transaction. With replace, the other vars of the group are deleted.
+func (r *DeployServiceRepo) upsertEnvGroupVars(groupId string, envs []EnvVar, replace bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.Prepare(`INSERT INTO env_group_vars (group_id, key, value, build_time, secret, sealed_value, data_key, key_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (group_id, key) DO UPDATE SET value = EXCLUDED.value, build_time = EXCLUDED.build_time, secret = EXCLUDED.secret,
+        sealed_value = EXCLUDED.sealed_value, data_key = EXCLUDED.data_key, key_id = EXCLUDED.key_id`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	keys := make([]string, 0, len(envs))
+	for _, env := range envs {
+		if _, err = stmt.Exec(groupId, env.Key, env.Value, env.BuildTime, env.Secret, env.sealed, env.dataKey, env.keyID); err != nil {
+			return err
+		}
+		keys = append(keys, env.Key)
+	}
+
+	if replace {
+		_, err = tx.Exec("DELETE FROM env_group_vars WHERE group_id = $1 AND NOT (key = ANY($2))", groupId, pq.Array(keys))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *DeployServiceRepo) updateEnvGroupVar(groupId string, env EnvVar) error {
+	_, err := r.db.Exec("UPDATE env_group_vars SET value = $1, build_time = $2, secret = $3, sealed_value = $4, data_key = $5, key_id = $6 WHERE group_id = $7 AND key = $8",
+		env.Value, env.BuildTime, env.Secret, env.sealed, env.dataKey, env.keyID, groupId, env.Key)
+	return err
+}
+
+// getEnvGroupVarsNotSealedWith returns the group vars per group that are
+// stored in plain or wrapped with another key than keyID.
+func (r *DeployServiceRepo) getEnvGroupVarsNotSealedWith(keyID string) (map[string][]EnvVar, error) {
+	rows, err := r.db.Query("SELECT group_id, "+envVarColumns+" FROM env_group_vars WHERE key_id <> $1", keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envVars := make(map[string][]EnvVar)
+	for rows.Next() {
+		var groupId string
+		var ev EnvVar
+		err := rows.Scan(&groupId, &ev.Key, &ev.Value, &ev.BuildTime, &ev.Secret, &ev.sealed, &ev.dataKey, &ev.keyID)
+		if err != nil {
+			return nil, err
+		}
+		envVars[groupId] = append(envVars[groupId], ev)
+	}
+
+	return envVars, rows.Err()
 }
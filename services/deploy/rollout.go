@@ -0,0 +1,109 @@
+package deploy
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// DefaultEnvRolloutDelay is how long env changes are collected before they
+// are rolled out together.
+const DefaultEnvRolloutDelay = 10 * time.Second
+
+// envRollouts batches env changes per deployment, every change within the
+// delay of the first one ends up in the same rollout.
+type envRollouts struct {
+	mutex   sync.Mutex
+	delay   time.Duration
+	pending map[string]*envRollout
+}
+
+type envRollout struct {
+	at time.Time
+	// rebuild is set when a build time var changed, which needs a new image
+	// instead of a restart.
+	rebuild bool
+	owner   string
+}
+
+func newEnvRollouts() *envRollouts {
+	return &envRollouts{
+		delay:   DefaultEnvRolloutDelay,
+		pending: make(map[string]*envRollout),
+	}
+}
+
+// SetEnvRolloutDelay overrides how long env changes are batched, zero keeps the default.
+func (d *DeployService) SetEnvRolloutDelay(delay time.Duration) {
+	if delay > 0 {
+		d.rollouts.delay = delay
+	}
+}
+
+// ScheduleEnvRollout rolls the env vars of the deployment out once the
+// current batch of changes is over and returns when that happens. Runtime
+// changes restart the current image, build time changes redeploy.
+func (d *DeployService) ScheduleEnvRollout(deploymentId string, rebuild bool, owner string, dockerCli *client.Client, events chan DeployEvent) time.Time {
+	r := d.rollouts
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if pending, ok := r.pending[deploymentId]; ok {
+		pending.rebuild = pending.rebuild || rebuild
+		return pending.at
+	}
+
+	pending := &envRollout{
+		at:      time.Now().Add(r.delay),
+		rebuild: rebuild,
+		owner:   owner,
+	}
+	r.pending[deploymentId] = pending
+	time.AfterFunc(r.delay, func() {
+		d.rolloutEnv(deploymentId, dockerCli, events)
+	})
+
+	return pending.at
+}
+
+func (d *DeployService) rolloutEnv(deploymentId string, dockerCli *client.Client, events chan DeployEvent) {
+	r := d.rollouts
+	r.mutex.Lock()
+	pending := r.pending[deploymentId]
+	delete(r.pending, deploymentId)
+	r.mutex.Unlock()
+
+	if pending == nil {
+		return
+	}
+
+	dep, err := d.GetDeploymentBasedOnID(deploymentId)
+	if err != nil {
+		log.Printf("{SERVER}: env rollout of %s dropped: %v\n", deploymentId, err)
+		return
+	}
+
+	if pending.rebuild {
+		d.EnqueueDeploy(&DeployJob{
+			Deployment: dep,
+			Redeploy:   true,
+			Trigger:    TriggerEnv,
+			Owner:      pending.owner,
+		})
+		return
+	}
+
+	_, err = d.ApplyEnv(dep, dockerCli, events)
+	if errors.Is(err, ErrDeploymentBusy) {
+		// the running deploy may have read the env before the change, try
+		// again once it is done.
+		d.ScheduleEnvRollout(deploymentId, false, pending.owner, dockerCli, events)
+		return
+	}
+	if err != nil {
+		log.Printf("{SERVER}: env rollout of %s failed: %v\n", deploymentId, err)
+	}
+}
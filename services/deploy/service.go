@@ -9,10 +9,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 )
 
 type DeployServiceRepo struct {
@@ -20,27 +25,53 @@ type DeployServiceRepo struct {
 }
 
 type DeployService struct {
-	repo DeployServiceRepo
-	dsm  *DeploymentStateManager
+	repo           DeployServiceRepo
+	buildLogs      map[string]*BuildLog
+	buildLogsMutex sync.RWMutex
+	queue          *BuildQueue
+	timeouts       StepTimeouts
+	statusConfig   CommitStatusConfig
+	statuses       chan commitStatus
+	// legacyCredentials opens git credentials sealed before they moved to envKeys.
+	legacyCredentials *secretBox
+	envKeys           *keyring
+	rollouts          *envRollouts
 }
 
+var ErrDeploymentBusy = errors.New("deployment is currently building")
+
 func newDeployServiceRepo(db *sql.DB) *DeployServiceRepo {
 	return &DeployServiceRepo{
 		db: db,
 	}
 }
 
-func newDeploymentStateManager() *DeploymentStateManager {
-	return &DeploymentStateManager{
-		mutex:  sync.RWMutex{},
-		States: make(map[string]*DeploymentState),
+func NewDeployService(db *sql.DB) *DeployService {
+	return &DeployService{
+		repo:      *newDeployServiceRepo(db),
+		buildLogs: make(map[string]*BuildLog),
+		queue:     newBuildQueue(),
+		rollouts:  newEnvRollouts(),
+		timeouts:  DefaultStepTimeouts,
 	}
 }
 
-func NewDeployService(db *sql.DB) *DeployService {
-	return &DeployService{
-		repo: *newDeployServiceRepo(db),
-		dsm:  newDeploymentStateManager(),
+var DefaultStepTimeouts = StepTimeouts{
+	Clone: 5 * time.Minute,
+	Build: 30 * time.Minute,
+	Start: 5 * time.Minute,
+}
+
+// SetStepTimeouts overrides the timeouts of the deploy steps, zero values keep the default.
+func (d *DeployService) SetStepTimeouts(timeouts StepTimeouts) {
+	if timeouts.Clone > 0 {
+		d.timeouts.Clone = timeouts.Clone
+	}
+	if timeouts.Build > 0 {
+		d.timeouts.Build = timeouts.Build
+	}
+	if timeouts.Start > 0 {
+		d.timeouts.Start = timeouts.Start
 	}
 }
 
@@ -49,17 +80,42 @@ func (d *DeployService) NewDeployment(deployment *Deployment) (*Deployment, erro
 		return nil, errors.New("Deployment already exists")
 	}
 
+	if _, err := path.Match(deployment.Branch, ""); err != nil {
+		return nil, fmt.Errorf("invalid branch pattern %q", deployment.Branch)
+	}
+	if err := validateRepoPath("root_dir", deployment.RootDir); err != nil {
+		return nil, err
+	}
+	if err := validateRepoPath("dockerfile_path", deployment.DockerfilePath); err != nil {
+		return nil, err
+	}
+	if err := ValidateEnvVars(deployment.EnvVars); err != nil {
+		return nil, err
+	}
+
 	deployment.ID = String(6)
 	deployment.ProjectPath = constructProjectPath(deployment.ID)
+	deployment.HealthCheck = deployment.HealthCheck.withDefaults()
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	deployment.WebhookSecret = secret
 
-	err := d.repo.addDeployment(deployment)
+	envs, err := d.sealEnvVars(deployment.ID, deployment.EnvVars)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.repo.addDeployment(deployment)
 	if err != nil {
 		fmt.Println("ERROR WHILE ADDING DEPLOYMENT")
 		fmt.Println(err)
 		return nil, err
 	}
 
-	err = d.repo.addEnvVars(deployment, deployment.EnvVars)
+	err = d.repo.addEnvVars(deployment, envs)
 
 	if err != nil {
 		fmt.Println("ERROR WHILE ADDING ENV VARS")
@@ -82,6 +138,7 @@ func (d *DeployService) NewDeploymentFromWebhook(RepoName string, CloneUrl strin
 		RepoName:    RepoName,
 		ProjectPath: constructProjectPath(Id),
 		Port:        3000,
+		HealthCheck: HealthCheck{}.withDefaults(),
 	}
 
 	err := d.repo.addDeployment(&deployment)
@@ -124,14 +181,23 @@ func (d *DeployService) CheckDeploymentExistenceBasedOnSubDomain(SubDomain strin
 	return true
 }
 
-func (d *DeployService) GetDeploymentBasedOnCloneUrl(CloneUrl string) (*Deployment, error) {
-	dep, err := d.repo.GetDeploymentBasedOnCloneUrl(CloneUrl)
+// GetDeploymentsBasedOnCloneUrls returns every deployment of the repository,
+// one per deployed branch. Git hosts send several URLs for a repository
+// (https, ssh) and deployments may use any of them.
+func (d *DeployService) GetDeploymentsBasedOnCloneUrls(CloneUrls []string) ([]*Deployment, error) {
+	deps, err := d.repo.GetDeploymentsBasedOnCloneUrls(CloneUrls)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return dep, nil
+	for _, dep := range deps {
+		if err := d.openEnvVars(dep); err != nil {
+			return nil, err
+		}
+	}
+
+	return deps, nil
 }
 
 func (d *DeployService) GetDeploymentBasedOnID(deploymentId string) (*Deployment, error) {
@@ -141,6 +207,12 @@ func (d *DeployService) GetDeploymentBasedOnID(deploymentId string) (*Deployment
 		return nil, err
 	}
 
+	err = d.openEnvVars(dep)
+
+	if err != nil {
+		return nil, err
+	}
+
 	return dep, nil
 }
 
@@ -152,17 +224,47 @@ func (d *DeployService) UpdateEnvVar(deployment *Deployment, oldEnv EnvVar, newE
 		return err
 	}
 
-	err = d.repo.updateEnvVar(deployment, oldEnv, newEnv)
+	newEnv.Key = oldEnv.Key
+	err = validateEnvValue(newEnv)
+
+	if err != nil {
+		return err
+	}
+
+	sealed, err := d.sealEnvVars(deployment.ID, []EnvVar{newEnv})
 
 	if err != nil {
-		return nil
+		return err
 	}
 
-	return err
+	return d.repo.updateEnvVar(deployment, oldEnv, sealed[0])
+}
+
+func (d *DeployService) GetEnvVar(deployment *Deployment, key string) (EnvVar, error) {
+	env := EnvVar{Key: key}
+	err := d.repo.getEnv(deployment, &env)
+	if err != nil {
+		return env, err
+	}
+
+	err = d.openEnvVar(deployment.ID, &env)
+	return env, err
 }
 
 func (d *DeployService) AddEnvs(deployment *Deployment, envs []EnvVar) error {
-	err := d.repo.addEnvVars(deployment, envs)
+	err := ValidateEnvVars(envs)
+
+	if err != nil {
+		return err
+	}
+
+	sealed, err := d.sealEnvVars(deployment.ID, envs)
+
+	if err != nil {
+		return err
+	}
+
+	err = d.repo.addEnvVars(deployment, sealed)
 
 	if err != nil {
 		return err
@@ -179,126 +281,420 @@ func (d *DeployService) DeleteEnvVar(deployment *Deployment, env EnvVar) error {
 		return err
 	}
 
-	err = d.repo.deleteEnvVar(deployment, env)
+	return d.repo.deleteEnvVar(deployment, env)
+}
 
+func (d *DeployService) StartRelease(deployment *Deployment, trigger ReleaseTrigger) (*Release, error) {
+	releaseId := String(8)
+	release := &Release{
+		ID:           releaseId,
+		DeploymentID: deployment.ID,
+		Trigger:      trigger,
+		ImageTag:     constructImageTag(deployment.ID, releaseId),
+		Status:       ReleaseRunning,
+		StartedAt:    time.Now(),
+	}
+
+	err := d.repo.addRelease(release)
 	if err != nil {
-		return nil
+		log.Println("{SERVER}: ERROR WHILE ADDING RELEASE")
+		log.Println(err.Error())
+		return nil, err
 	}
 
-	return err
+	return release, nil
 }
 
-func (d *DeployService) Deploy(deployment *Deployment, dockerCli *client.Client, redeploy bool, sse chan string, errsse chan string) error {
-	err := d.GetCodeBase(deployment)
+func (d *DeployService) FinishRelease(release *Release, status ReleaseStatus, failedStep string, reason string) error {
+	finishedAt := time.Now()
+	release.Status = status
+	release.FinishedAt = &finishedAt
+	release.FailedStep = failedStep
+	release.FailureReason = reason
+
+	d.finishBuildLog(release)
+
+	err := d.repo.updateRelease(release)
 	if err != nil {
-		log.Println("{SERVER}: ERROR IN FETCHING CODEBASE")
+		log.Println("{SERVER}: ERROR WHILE UPDATING RELEASE")
 		log.Println(err.Error())
-		sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "codebase clone failed"))
 		return err
 	}
-	sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "codebase cloned"))
 
-	dockerFileExists := d.FindDockerFile(deployment)
-	if redeploy {
-		dockerFileExists = false
+	return nil
+}
+
+func (d *DeployService) GetLatestRelease(deploymentId string) (*Release, error) {
+	release, err := d.repo.getLatestReleaseForDeployment(deploymentId)
+
+	if err != nil {
+		return nil, err
 	}
 
-	if dockerFileExists {
-		err := d.BuildImage(deployment)
-		if err != nil {
-			log.Println("{SERVER}: ERROR IN BUILDING IMAGE")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "docker image build failed"))
-			return err
+	return release, nil
+}
+
+func (d *DeployService) GetRelease(releaseId string) (*Release, error) {
+	release, err := d.repo.getReleaseByID(releaseId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return release, nil
+}
+
+func (d *DeployService) GetReleases(deploymentId string) ([]*Release, error) {
+	releases, err := d.repo.getReleasesForDeployment(deploymentId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// Rollback starts a new release that runs the image of an earlier successful
+// release, skipping the clone and build steps entirely.
+func (d *DeployService) Rollback(deployment *Deployment, releaseId string, dockerCli *client.Client, events chan DeployEvent) (*Release, error) {
+	ctx, ok := d.queue.acquire(deployment.ID)
+	if !ok {
+		return nil, ErrDeploymentBusy
+	}
+	defer d.queue.release(deployment.ID)
+
+	target, err := d.repo.getReleaseByID(releaseId)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.DeploymentID != deployment.ID {
+		return nil, errors.New("release doesn't belong to deployment")
+	}
+
+	if target.Status != ReleaseSucceeded {
+		return nil, errors.New("only successful releases can be rolled back to")
+	}
+
+	return d.startFromImage(ctx, deployment, target, TriggerRollback, dockerCli, events)
+}
+
+// ApplyEnv recreates the container of the current release so it picks up
+// changed env vars. Build time vars only change with the next build.
+func (d *DeployService) ApplyEnv(deployment *Deployment, dockerCli *client.Client, events chan DeployEvent) (*Release, error) {
+	ctx, ok := d.queue.acquire(deployment.ID)
+	if !ok {
+		return nil, ErrDeploymentBusy
+	}
+	defer d.queue.release(deployment.ID)
+
+	releases, err := d.repo.getReleasesForDeployment(deployment.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range releases {
+		if target.Status == ReleaseSucceeded {
+			return d.startFromImage(ctx, deployment, target, TriggerEnv, dockerCli, events)
 		}
-		sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "docker image built"))
+	}
 
-		err = d.ContainerCreate(deployment, dockerCli)
-		if err != nil {
-			log.Println("{SERVER}: ERROR IN STARTING CONTAINER")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "container creation failed"))
-			return err
+	return nil, errors.New("deployment has no successful release to restart")
+}
+
+// startFromImage starts a new release running the image of the target
+// release. The caller has to hold the deployment in the queue, ctx is the one
+// it got from acquire so the start can be cancelled like a build.
+func (d *DeployService) startFromImage(ctx context.Context, deployment *Deployment, target *Release, trigger ReleaseTrigger, dockerCli *client.Client, events chan DeployEvent) (*Release, error) {
+	_, err := dockerCli.ImageInspect(ctx, target.ImageTag)
+	if err != nil {
+		return nil, fmt.Errorf("image for release %s is no longer available: %v", target.ID, err)
+	}
+
+	deployment, err = d.withResolvedEnv(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	release := &Release{
+		ID:           String(8),
+		DeploymentID: deployment.ID,
+		CommitSHA:    target.CommitSHA,
+		Trigger:      trigger,
+		ImageTag:     target.ImageTag,
+		Status:       ReleaseRunning,
+		StartedAt:    time.Now(),
+	}
+
+	err = d.repo.addRelease(release)
+	if err != nil {
+		log.Println("{SERVER}: ERROR WHILE ADDING RELEASE")
+		log.Println(err.Error())
+		return nil, err
+	}
+
+	action := "rollback"
+	if trigger == TriggerEnv {
+		action = "restart"
+	}
+
+	d.dsmTransition(deployment.ID, StatusQueued, release.ID, fmt.Sprintf("Starting %s..", action))
+	d.dsmTransition(deployment.ID, StatusStarting, release.ID, "Starting..")
+
+	startCtx, cancel := context.WithTimeout(ctx, d.timeouts.Start)
+	defer cancel()
+
+	err = d.ContainerCreate(startCtx, deployment, release, dockerCli)
+	if errors.Is(err, ErrHealthCheckFailed) {
+		return release, d.failDeploy(ctx, deployment, release, StepHealthCheck, "health check failed, previous container kept", err, events)
+	}
+	if err != nil {
+		return release, d.failDeploy(ctx, deployment, release, StepContainer, "container creation failed", stepError(startCtx, err, d.timeouts.Start), events)
+	}
+	sendEvent(events, newDeployEvent(deployment, StepContainer, EventSuccess, action+" successful"))
+	d.FinishRelease(release, ReleaseSucceeded, "", "")
+	d.dsmTransition(deployment.ID, StatusHealthy, release.ID, action+" successful")
+
+	return release, nil
+}
+
+// failDeploy logs the error of a pipeline step, notifies the client and
+// records the step on the release before handing the error back to Deploy.
+// Steps that stopped because the deploy was cancelled mark the release cancelled.
+func (d *DeployService) failDeploy(ctx context.Context, deployment *Deployment, release *Release, step string, msg string, err error, events chan DeployEvent) error {
+	status := ReleaseFailed
+	if errors.Is(ctx.Err(), context.Canceled) {
+		status = ReleaseCancelled
+		msg = "deployment cancelled"
+		err = ctx.Err()
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		msg = fmt.Sprintf("%s (timed out)", msg)
+	}
+
+	log.Printf("{SERVER}: ERROR IN STEP %s\n", step)
+	log.Println(err.Error())
+	d.buildLogf(release, "==> %s: %v", msg, err)
+	sendEvent(events, newDeployEvent(deployment, step, EventError, msg))
+	d.FinishRelease(release, status, step, err.Error())
+
+	commitState := CommitFailure
+	if status == ReleaseCancelled {
+		commitState = CommitError
+	}
+	d.reportCommitStatus(deployment, release, commitState, msg)
+
+	stateStatus := StatusFailed
+	if status == ReleaseCancelled {
+		stateStatus = StatusCancelled
+	}
+	d.dsmTransition(deployment.ID, stateStatus, release.ID, fmt.Sprintf("%s: %v", msg, err))
+
+	return err
+}
+
+// stepError replaces the error of a step that ran into its timeout, since
+// killed processes only report the signal they received.
+func stepError(stepCtx context.Context, err error, timeout time.Duration) error {
+	if errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("step did not finish within %v: %w", timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// removeReleaseImage removes what was built for a release that did not succeed.
+func (d *DeployService) removeReleaseImage(release *Release, dockerCli *client.Client) {
+	_, err := dockerCli.ImageRemove(context.Background(), release.ImageTag, image.RemoveOptions{PruneChildren: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		fmt.Println("{SERVER}: Failed to remove image of release:", err.Error())
+	}
+}
+
+// checkoutFor returns what the job builds. Deployments that follow a branch
+// pattern have no single branch to pull, so without a pushed commit they
+// rebuild the commit of their last successful release.
+func (d *DeployService) checkoutFor(job *DeployJob) Checkout {
+	checkout := job.Checkout
+	if checkout.Ref != "" || checkout.Branch != "" || checkout.CommitSHA != "" {
+		return checkout
+	}
+
+	if !isBranchPattern(job.Deployment.Branch) {
+		checkout.Branch = job.Deployment.Branch
+		return checkout
+	}
+
+	releases, err := d.repo.getReleasesForDeployment(job.Deployment.ID)
+	if err != nil {
+		log.Println("{SERVER}: ERROR IN FETCHING RELEASES")
+		log.Println(err.Error())
+		return checkout
+	}
+
+	for _, release := range releases {
+		if release.Status == ReleaseSucceeded && release.CommitSHA != "" {
+			checkout.CommitSHA = release.CommitSHA
+			break
 		}
-		sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "deployment successful"))
-		return nil
+	}
+	return checkout
+}
+
+func (d *DeployService) Deploy(ctx context.Context, job *DeployJob, dockerCli *client.Client, events chan DeployEvent) error {
+	deployment := job.Deployment
+
+	release, err := d.StartRelease(deployment, job.Trigger)
+	if err != nil {
+		log.Println("{SERVER}: ERROR IN STARTING RELEASE")
+		log.Println(err.Error())
+		sendEvent(events, newDeployEvent(deployment, StepRelease, EventError, "release creation failed"))
+		d.dsmTransition(deployment.ID, StatusFailed, "", "release creation failed")
+		return err
+	}
+
+	d.linkDeliveries(job, release)
+	buildLog := d.startBuildLog(release.ID)
+	d.dsmTransition(deployment.ID, StatusCloning, release.ID, "Cloning..")
+
+	defer func() {
+		if release.Status != ReleaseSucceeded {
+			d.removeReleaseImage(release, dockerCli)
+		}
+	}()
+
+	resolved, err := d.withResolvedEnv(deployment)
+	if err != nil {
+		return d.failDeploy(ctx, deployment, release, StepEnv, "env vars could not be resolved", err, events)
+	}
+	deployment = resolved
+
+	// the steps up to the build work on a copy of the deployment whose
+	// ProjectPath is the release's build directory.
+	build := *deployment
+	build.ProjectPath = constructBuildDir(deployment, release.ID)
+	defer func() {
+		if err := os.RemoveAll(build.ProjectPath); err != nil {
+			fmt.Println("{SERVER}: Failed to remove build directory:", err.Error())
+		}
+	}()
+
+	checkout := d.checkoutFor(job)
+	release.CommitSHA = checkout.CommitSHA
+	buildLog.Printf("==> fetching %s %s %s %s", deployment.CloneUrl, checkout.Branch, checkout.CommitSHA, checkout.Ref)
+	cloneCtx, cancel := context.WithTimeout(ctx, d.timeouts.Clone)
+	err = d.GetCodeBase(cloneCtx, &build, checkout, buildLog)
+	cancel()
+	if err != nil {
+		return d.failDeploy(ctx, deployment, release, StepClone, "codebase clone failed", stepError(cloneCtx, err, d.timeouts.Clone), events)
+	}
+	sendEvent(events, newDeployEvent(deployment, StepClone, EventSuccess, "codebase cloned"))
+
+	sha, err := d.GetCommitSHA(&build)
+	if err != nil {
+		log.Println("{SERVER}: ERROR IN RESOLVING COMMIT SHA")
+		log.Println(err.Error())
 	} else {
-		service, err := d.ServiceDiscovery(deployment)
+		release.CommitSHA = sha
+	}
+	d.reportCommitStatus(deployment, release, CommitPending, "deploying to "+deployment.SubDomain)
+
+	dockerFileExists := d.FindDockerFile(&build)
+	if deployment.DockerfilePath != "" && !dockerFileExists {
+		return d.failDeploy(ctx, deployment, release, StepDockerFile, "docker file not found", fmt.Errorf("%s doesn't exist in the repository", deployment.DockerfilePath), events)
+	}
+
+	if !dockerFileExists {
+		service, err := d.ServiceDiscovery(&build)
 		if err != nil {
-			log.Println("{SERVER}: ERROR IN SERVICE DISCOVERY")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "service discovery failed"))
-			return err
+			return d.failDeploy(ctx, deployment, release, StepServiceDiscovery, "service discovery failed", err, events)
 		}
-		sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "service discovered"))
+		sendEvent(events, newDeployEvent(deployment, StepServiceDiscovery, EventSuccess, "service discovered"))
 
-		err = d.CreateDockerFile(deployment, DockerTemplateData{
+		err = d.CreateDockerFile(&build, DockerTemplateData{
 			Port:           deployment.Port,
 			RepoIdentifier: deployment.ID,
-			EnvVars:        deployment.EnvVars,
+			EnvVars:        buildTimeEnvVars(deployment.EnvVars),
 		}, service)
 		if err != nil {
-			log.Println("{SERVER}: ERROR IN CREATING DOCKER FILE")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "docker file creation failed"))
-			return err
+			return d.failDeploy(ctx, deployment, release, StepDockerFile, "docker file creation failed", err, events)
 		}
-		sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "docker file created"))
-
-		err = d.BuildImage(deployment)
-		if err != nil {
-			log.Println("{SERVER}: ERROR IN BUILDING IMAGE")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "docker image build failed"))
-			return err
-		}
-		sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "docker image built"))
+		sendEvent(events, newDeployEvent(deployment, StepDockerFile, EventSuccess, "docker file created"))
+	}
 
-		err = d.ContainerCreate(deployment, dockerCli)
-		if err != nil {
-			log.Println("{SERVER}: ERROR IN STARTING CONTAINER")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "container creation failed"))
-			return err
-		}
-		sendEvent(sse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "deployment successful"))
-		err = d.DSM_DeleteDeployment(deployment.ID)
+	d.dsmTransition(deployment.ID, StatusBuilding, release.ID, "Building..")
+	buildLog.Printf("==> building image %s", release.ImageTag)
+	buildCtx, cancel := context.WithTimeout(ctx, d.timeouts.Build)
+	err = d.BuildImage(buildCtx, &build, release.ImageTag, buildLog)
+	cancel()
+	if err != nil {
+		return d.failDeploy(ctx, deployment, release, StepBuild, "docker image build failed", stepError(buildCtx, err, d.timeouts.Build), events)
+	}
+	sendEvent(events, newDeployEvent(deployment, StepBuild, EventSuccess, "docker image built"))
 
-		if err != nil {
-			log.Println("{SERVER}: ERROR IN DEL FROM DSM")
-			log.Println(err.Error())
-			sendEvent(errsse, fmt.Sprintf("%s:%s:%s", deployment.ID, deployment.SubDomain, "status update failed"))
-			return err
-		}
-		return nil
+	d.dsmTransition(deployment.ID, StatusStarting, release.ID, "Starting..")
+	buildLog.Printf("==> starting container")
+	startCtx, cancel := context.WithTimeout(ctx, d.timeouts.Start)
+	err = d.ContainerCreate(startCtx, deployment, release, dockerCli)
+	cancel()
+	if errors.Is(err, ErrHealthCheckFailed) {
+		return d.failDeploy(ctx, deployment, release, StepHealthCheck, "health check failed, previous container kept", err, events)
 	}
-}
+	if err != nil {
+		return d.failDeploy(ctx, deployment, release, StepContainer, "container creation failed", stepError(startCtx, err, d.timeouts.Start), events)
+	}
+	sendEvent(events, newDeployEvent(deployment, StepContainer, EventSuccess, "deployment successful"))
+	buildLog.Printf("==> deployment successful")
+	d.FinishRelease(release, ReleaseSucceeded, "", "")
+	d.reportCommitStatus(deployment, release, CommitSuccess, "deployed to "+deployment.SubDomain)
+	d.dsmTransition(deployment.ID, StatusHealthy, release.ID, "deployment successful")
 
-func (d *DeployService) GetDeploymentStats(deployment *Deployment, dockercli *client.Client, ctx context.Context) (*ContainerStats, error) {
-	containers, err := dockercli.ContainerList(ctx, container.ListOptions{})
+	return nil
+}
 
+// withResolvedEnv returns a copy of the deployment with the env vars a
+// rollout runs with, including changes made while it was queued and the vars
+// of its env groups.
+func (d *DeployService) withResolvedEnv(deployment *Deployment) (*Deployment, error) {
+	envs, err := d.ResolveEnvVars(deployment.ID)
 	if err != nil {
-		fmt.Println("ERROR WHILE GETTING CONTAINER LIST")
-		fmt.Println(err)
 		return nil, err
 	}
 
-	var containerId string
-	var state string
-	for _, container := range containers {
-		if container.Image == fmt.Sprintf("%v-image", deployment.ID) {
-			containerId = container.ID
-			state = container.State
-			break
+	resolved := *deployment
+	resolved.EnvVars = envs
+	return &resolved, nil
+}
+
+// buildTimeEnvVars returns the vars that are rendered into generated
+// Dockerfiles, the rest only reach the container at runtime.
+func buildTimeEnvVars(envs []EnvVar) []EnvVar {
+	result := make([]EnvVar, 0)
+	for _, env := range envs {
+		if env.BuildTime {
+			result = append(result, env)
 		}
 	}
+	return result
+}
+
+func (d *DeployService) GetDeploymentStats(deployment *Deployment, dockercli *client.Client, ctx context.Context) (*ContainerStats, error) {
+	containerId, err := d.findDeploymentContainer(ctx, deployment, dockercli)
 
-	if containerId == "" {
+	if err != nil {
 		return &ContainerStats{
 			Status: "STOPPED",
 		}, nil
 	}
 
+	info, err := dockercli.ContainerInspect(ctx, containerId)
+
+	if err != nil {
+		fmt.Println("ERROR WHILE INSPECTING CONTAINER")
+		fmt.Println(err)
+		return nil, err
+	}
+
+	state := info.State.Status
+
 	containerStats := &ContainerStats{
 		Status: state,
 	}
@@ -358,7 +754,10 @@ func (d *DeployService) GetDeploymentStats(deployment *Deployment, dockercli *cl
 }
 
 func (d *DeployService) GetContainerLogs(deployment *Deployment, dockercli *client.Client) ([]string, error) {
-	containerName := deployment.ID
+	containerName, err := d.findDeploymentContainer(context.Background(), deployment, dockercli)
+	if err != nil {
+		return nil, fmt.Errorf("error finding container: %v", err)
+	}
 
 	options := container.LogsOptions{
 		ShowStdout: true,
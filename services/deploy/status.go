@@ -0,0 +1,264 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type StatusProvider string
+
+const (
+	// StatusGithub also covers Gitea and Forgejo, which serve the same API.
+	StatusGithub    StatusProvider = "github"
+	StatusGitlab    StatusProvider = "gitlab"
+	StatusBitbucket StatusProvider = "bitbucket"
+)
+
+// StatusHost is the commit status API of one git host. APIURL defaults to
+// the public API of the provider on the host. Bitbucket tokens of the form
+// user:app-password are sent as basic auth, others as bearer tokens.
+type StatusHost struct {
+	Provider StatusProvider
+	APIURL   string
+	Token    string
+}
+
+// CommitStatusConfig points the commit statuses of releases at the git hosts
+// of their deployments. Deployments on hosts without a token report nothing.
+type CommitStatusConfig struct {
+	// Hosts are keyed by the host of the clone urls, like github.com.
+	Hosts map[string]StatusHost
+	// PublicURL is where this server is reachable, for the links to the
+	// build logs of a release.
+	PublicURL string
+}
+
+type CommitState string
+
+const (
+	CommitPending CommitState = "pending"
+	CommitSuccess CommitState = "success"
+	CommitFailure CommitState = "failure"
+	CommitError   CommitState = "error"
+)
+
+type commitStatus struct {
+	host     StatusHost
+	endpoint string
+	body     []byte
+}
+
+// defaultStatusAPI returns the API of the provider when it is served from
+// the git host itself.
+func defaultStatusAPI(provider StatusProvider, host string) string {
+	switch provider {
+	case StatusGithub:
+		if host == "github.com" {
+			return "https://api.github.com"
+		}
+		return "https://" + host + "/api/v1"
+	case StatusGitlab:
+		return "https://" + host + "/api/v4"
+	case StatusBitbucket:
+		return "https://api.bitbucket.org/2.0"
+	}
+	return ""
+}
+
+// SetCommitStatusConfig turns on commit status reporting. Statuses are posted
+// in the background, one at a time so they arrive in order.
+func (d *DeployService) SetCommitStatusConfig(config CommitStatusConfig) {
+	hosts := make(map[string]StatusHost, 0)
+	for name, host := range config.Hosts {
+		if host.Token == "" {
+			continue
+		}
+		if host.APIURL == "" {
+			host.APIURL = defaultStatusAPI(host.Provider, name)
+		}
+		if host.APIURL == "" {
+			log.Printf("{SERVER}: unknown commit status provider %q for %s\n", host.Provider, name)
+			continue
+		}
+		host.APIURL = strings.TrimSuffix(host.APIURL, "/")
+		hosts[name] = host
+
+		fmt.Printf("{SERVER}: reporting commit statuses of %s to %s\n", name, host.APIURL)
+	}
+	if len(hosts) == 0 {
+		return
+	}
+
+	config.Hosts = hosts
+	config.PublicURL = strings.TrimSuffix(config.PublicURL, "/")
+
+	d.statusConfig = config
+	d.statuses = make(chan commitStatus, 100)
+
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		for status := range d.statuses {
+			err := postCommitStatus(client, status)
+			if err != nil {
+				log.Printf("{SERVER}: failed to report commit status to %s: %v\n", status.endpoint, err)
+			}
+		}
+	}()
+}
+
+// repoLocation returns the host and the owner/repo path of https, ssh:// and
+// scp-like git@host:owner/repo.git clone urls. GitLab paths may have subgroups.
+func repoLocation(cloneUrl string) (string, string, error) {
+	var host, repoPath string
+	if u, err := url.Parse(cloneUrl); err == nil && u.Host != "" {
+		host, repoPath = u.Hostname(), u.Path
+	} else if h, p, ok := strings.Cut(cloneUrl, ":"); ok {
+		_, host, _ = strings.Cut(h, "@")
+		if host == "" {
+			host = h
+		}
+		repoPath = p
+	}
+
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	parts := strings.Split(repoPath, "/")
+	if host == "" || len(parts) < 2 || parts[len(parts)-2] == "" || parts[len(parts)-1] == "" {
+		return "", "", fmt.Errorf("no owner/repo in clone url %q", cloneUrl)
+	}
+
+	return host, repoPath, nil
+}
+
+// commitStatusBody returns the endpoint and payload of the status on the
+// provider's API.
+func commitStatusBody(host StatusHost, repoPath string, sha string, state CommitState, targetUrl string, description string, name string) (string, []byte, error) {
+	switch host.Provider {
+	case StatusGitlab:
+		gitlabState := map[CommitState]string{
+			CommitPending: "running",
+			CommitSuccess: "success",
+			CommitFailure: "failed",
+			CommitError:   "canceled",
+		}[state]
+
+		body, err := json.Marshal(map[string]string{
+			"state":       gitlabState,
+			"target_url":  targetUrl,
+			"description": description,
+			"name":        name,
+		})
+		return fmt.Sprintf("%s/projects/%s/statuses/%s", host.APIURL, url.PathEscape(repoPath), sha), body, err
+	case StatusBitbucket:
+		bitbucketState := map[CommitState]string{
+			CommitPending: "INPROGRESS",
+			CommitSuccess: "SUCCESSFUL",
+			CommitFailure: "FAILED",
+			CommitError:   "STOPPED",
+		}[state]
+
+		body, err := json.Marshal(map[string]string{
+			"key":         name,
+			"state":       bitbucketState,
+			"url":         targetUrl,
+			"description": description,
+		})
+		return fmt.Sprintf("%s/repositories/%s/commit/%s/statuses/build", host.APIURL, repoPath, sha), body, err
+	default:
+		body, err := json.Marshal(map[string]string{
+			"state":       string(state),
+			"target_url":  targetUrl,
+			"description": description,
+			"context":     name,
+		})
+		return fmt.Sprintf("%s/repos/%s/statuses/%s", host.APIURL, repoPath, sha), body, err
+	}
+}
+
+// truncateDescription shortens the description to at most max runes, the APIs
+// reject longer ones as well as ones cut in the middle of a character.
+func truncateDescription(description string, max int) string {
+	runes := []rune(description)
+	if len(runes) <= max {
+		return description
+	}
+	return string(runes[:max-3]) + "..."
+}
+
+// reportCommitStatus queues the status of the release's commit for the git host.
+func (d *DeployService) reportCommitStatus(deployment *Deployment, release *Release, state CommitState, description string) {
+	if d.statuses == nil || release.CommitSHA == "" {
+		return
+	}
+
+	hostName, repoPath, err := repoLocation(deployment.CloneUrl)
+	if err != nil {
+		log.Println("{SERVER}: ERROR IN REPORTING COMMIT STATUS")
+		log.Println(err.Error())
+		return
+	}
+
+	host, ok := d.statusConfig.Hosts[hostName]
+	if !ok {
+		return
+	}
+
+	description = truncateDescription(description, 140)
+
+	targetUrl := ""
+	if d.statusConfig.PublicURL != "" {
+		targetUrl = fmt.Sprintf("%s/deployment/%s/build-logs?release=%s", d.statusConfig.PublicURL, deployment.ID, release.ID)
+	}
+
+	endpoint, body, err := commitStatusBody(host, repoPath, release.CommitSHA, state, targetUrl, description, "orchestration/"+deployment.SubDomain)
+	if err != nil {
+		return
+	}
+
+	select {
+	case d.statuses <- commitStatus{host: host, endpoint: endpoint, body: body}:
+	default:
+		log.Printf("{SERVER}: dropped commit status of %s, too many pending\n", release.CommitSHA)
+	}
+}
+
+func postCommitStatus(client *http.Client, status commitStatus) error {
+	req, err := http.NewRequest(http.MethodPost, status.endpoint, bytes.NewReader(status.body))
+	if err != nil {
+		return err
+	}
+
+	token := status.host.Token
+	switch status.host.Provider {
+	case StatusGitlab:
+		req.Header.Set("PRIVATE-TOKEN", token)
+	case StatusBitbucket:
+		if user, password, ok := strings.Cut(token, ":"); ok {
+			req.SetBasicAuth(user, password)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	default:
+		req.Header.Set("Authorization", "token "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.New(res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package deploy
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		want        string
+	}{
+		{"short", "deployed to app", "deployed to app"},
+		{"exactly max", strings.Repeat("a", 140), strings.Repeat("a", 140)},
+		{"ascii", strings.Repeat("a", 141), strings.Repeat("a", 137) + "..."},
+		{"multi-byte", strings.Repeat("ü", 141), strings.Repeat("ü", 137) + "..."},
+		{"multi-byte under max", strings.Repeat("ü", 100), strings.Repeat("ü", 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateDescription(tt.description, 140)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("%q is not valid UTF-8", got)
+			}
+		})
+	}
+}
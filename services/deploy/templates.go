@@ -3,6 +3,7 @@ package deploy
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"text/template"
 )
 
@@ -11,7 +12,7 @@ FROM node:22-alpine
 WORKDIR /app
 COPY . ./
 {{range .EnvVars}}
-ENV {{.Key}}="{{.Value}}"
+ENV {{.Key}}={{quote .Value}}
 {{end}}
 RUN npm install
 EXPOSE {{.Port}}
@@ -23,7 +24,7 @@ FROM golang:1.24-bookworm
 WORKDIR /app
 COPY . ./
 {{range .EnvVars}}
-ENV {{.Key}}={{.Value}}
+ENV {{.Key}}={{quote .Value}}
 {{end}}
 RUN go build -o app ./cmd
 EXPOSE {{.Port}}
@@ -36,7 +37,7 @@ WORKDIR /app
 # Copy package files
 COPY ./package*.json ./
 {{range .EnvVars}}
-ENV {{.Key}}="{{.Value}}"
+ENV {{.Key}}={{quote .Value}}
 {{end}}
 # Install dependencies
 RUN npm install --prefer-offline --no-audit --progress=false
@@ -63,7 +64,7 @@ COPY ./package*.json ./
 
 # Set environment variables
 {{range .EnvVars}}
-ENV {{.Key}}="{{.Value}}"
+ENV {{.Key}}={{quote .Value}}
 {{end}}
 
 # Install dependencies
@@ -85,49 +86,54 @@ EXPOSE {{.Port}}
 CMD ["serve", "-s", "dist", "-l", "{{.Port}}"]
 `
 
-var ViteReactFile = template.Must(template.New("").Parse(ViteReactDockerFileTemplate))
-var NodeDockerFile = template.Must(template.New("").Parse(NodeDockerFileTemplate))
-var NextDockerFile = template.Must(template.New("").Parse(NextjsDockerFileTemplate))
-var GoDockerFile = template.Must(template.New("").Parse(GoDockerFileTemplate))
+// dockerfileQuoter escapes what the Dockerfile parser would otherwise read in
+// a double quoted ENV value: backslashes, quotes and $ variable expansion.
+var dockerfileQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
 
-func ExecuteNodeTemplate(data DockerTemplateData) string {
-
-	for i := 0; i < len(data.EnvVars); i++ {
-		fmt.Println(data.EnvVars[i].Value)
+// quoteEnvValue renders a build-time value as a double quoted ENV value.
+// Newlines can't be escaped there and would start a new instruction.
+func quoteEnvValue(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("%w: build-time values can't contain newlines", ErrInvalidEnvVar)
 	}
+	return `"` + dockerfileQuoter.Replace(value) + `"`, nil
+}
+
+var templateFuncs = template.FuncMap{"quote": quoteEnvValue}
 
+var ViteReactFile = template.Must(template.New("").Funcs(templateFuncs).Parse(ViteReactDockerFileTemplate))
+var NodeDockerFile = template.Must(template.New("").Funcs(templateFuncs).Parse(NodeDockerFileTemplate))
+var NextDockerFile = template.Must(template.New("").Funcs(templateFuncs).Parse(NextjsDockerFileTemplate))
+var GoDockerFile = template.Must(template.New("").Funcs(templateFuncs).Parse(GoDockerFileTemplate))
+
+func ExecuteNodeTemplate(data DockerTemplateData) (string, error) {
 	buf := bytes.Buffer{}
 	if err := NodeDockerFile.Execute(&buf, data); err != nil {
-		fmt.Println("Error", err)
-		return ""
+		return "", err
 	}
-	return buf.String()
+	return buf.String(), nil
 }
 
-func ExecuteViteReactTemplate(data DockerTemplateData) string {
+func ExecuteViteReactTemplate(data DockerTemplateData) (string, error) {
 	buf := bytes.Buffer{}
 	if err := ViteReactFile.Execute(&buf, data); err != nil {
-		fmt.Println("Error", err)
-		return ""
+		return "", err
 	}
-
-	return buf.String()
+	return buf.String(), nil
 }
 
-func ExecuteGoTemplate(data DockerTemplateData) string {
+func ExecuteGoTemplate(data DockerTemplateData) (string, error) {
 	buf := bytes.Buffer{}
 	if err := GoDockerFile.Execute(&buf, data); err != nil {
-		fmt.Println("Error", err)
-		return ""
+		return "", err
 	}
-	return buf.String()
+	return buf.String(), nil
 }
 
-func ExecuteNextTemplate(data DockerTemplateData) string {
+func ExecuteNextTemplate(data DockerTemplateData) (string, error) {
 	buf := bytes.Buffer{}
 	if err := NextDockerFile.Execute(&buf, data); err != nil {
-		fmt.Println("Error", err)
-		return ""
+		return "", err
 	}
-	return buf.String()
+	return buf.String(), nil
 }
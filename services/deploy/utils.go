@@ -4,13 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
@@ -44,15 +50,92 @@ func String(length int) string {
 	return StringWithCharset(length, charset)
 }
 
+const projectsDir = "/projects"
+
 func constructProjectPath(id string) string {
-	return fmt.Sprintf("/projects/%v", id)
+	return fmt.Sprintf("%v/%v", projectsDir, id)
+}
+
+// every release is checked out and built in a directory of its own, which is
+// removed once the deploy is done.
+func constructBuildDir(deployment *Deployment, releaseId string) string {
+	return filepath.Join(deployment.ProjectPath, "builds", releaseId)
+}
+
+// cleanBuildDirs removes the build directories that deploys interrupted by a
+// restart left behind, and the checkouts older versions kept in the project
+// directory itself. It has to run before any build starts.
+func cleanBuildDirs() {
+	entries, err := os.ReadDir(projectsDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		projectPath := filepath.Join(projectsDir, entry.Name())
+		target := filepath.Join(projectPath, "builds")
+		if legacy, _ := exists(filepath.Join(projectPath, ".git")); legacy {
+			target = projectPath
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			fmt.Println("{SERVER}: Failed to clean build directory:", err.Error())
+		}
+	}
+}
+
+// constructBuildPath returns the directory the deployment is built from.
+func constructBuildPath(deployment *Deployment) string {
+	return filepath.Join(deployment.ProjectPath, deployment.RootDir)
+}
+
+// dockerFilePath returns the Dockerfile the deployment is built with.
+func dockerFilePath(deployment *Deployment) string {
+	if deployment.DockerfilePath != "" {
+		return filepath.Join(constructBuildPath(deployment), deployment.DockerfilePath)
+	}
+	return filepath.Join(constructBuildPath(deployment), "Dockerfile")
+}
+
+// validateRepoPath makes sure a path from the user stays inside the repository.
+func validateRepoPath(name string, p string) error {
+	if p != "" && !filepath.IsLocal(p) {
+		return fmt.Errorf("%s has to be a relative path inside the repository", name)
+	}
+	return nil
+}
+
+// TouchesRootDir reports whether any of the changed paths lie in the
+// deployment's root directory.
+func (d *DeployService) TouchesRootDir(deployment *Deployment, paths []string) bool {
+	root := filepath.Clean(deployment.RootDir)
+	if deployment.RootDir == "" || root == "." {
+		return true
+	}
+
+	for _, p := range paths {
+		if p == root || strings.HasPrefix(p, root+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// every release gets its own tag so that earlier builds stay around for rollbacks.
+func constructImageTag(deploymentId string, releaseId string) string {
+	return fmt.Sprintf("%v-image:%v", deploymentId, releaseId)
 }
 
 func (d *DeployService) CreateDockerFile(deployment *Deployment, data DockerTemplateData, ProjectType int) error {
 
 	fmt.Println("Project Type is ", ProjectType)
 
-	f, err := os.Create(fmt.Sprintf("%v/Dockerfile", deployment.ProjectPath))
+	f, err := os.Create(dockerFilePath(deployment))
 
 	if err != nil {
 		return err
@@ -60,29 +143,36 @@ func (d *DeployService) CreateDockerFile(deployment *Deployment, data DockerTemp
 
 	defer f.Close()
 
+	var content string
 	switch ProjectType {
 	case node:
-		_, err = f.WriteString(ExecuteNodeTemplate(data))
-		return err
+		content, err = ExecuteNodeTemplate(data)
 	case next:
-		_, err = f.WriteString(ExecuteNextTemplate(data))
-		return err
+		content, err = ExecuteNextTemplate(data)
 	case golang:
-		_, err := f.WriteString(ExecuteGoTemplate(data))
-		return err
+		content, err = ExecuteGoTemplate(data)
 	case react:
-		_, err := f.WriteString(ExecuteViteReactTemplate(data))
-		return err
+		content, err = ExecuteViteReactTemplate(data)
 	default:
 		return errors.New("invalid project type")
 	}
 
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(content)
+	return err
 }
 
-func (d *DeployService) BuildImage(deployment *Deployment) error {
-	cmd := exec.Command("docker", "build", "-t", fmt.Sprintf("%v-image", deployment.ID), deployment.ProjectPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func (d *DeployService) BuildImage(ctx context.Context, deployment *Deployment, imageTag string, out io.Writer) error {
+	// --force-rm drops the intermediate containers of failed and cancelled builds too.
+	cmd := exec.CommandContext(ctx, "docker", "build", "--force-rm", "-t", imageTag, "-f", dockerFilePath(deployment), constructBuildPath(deployment))
+	// build time secrets show up in the steps docker prints.
+	masked := newMaskingWriter(io.MultiWriter(os.Stdout, out), secretValues(deployment.EnvVars))
+	defer masked.Flush()
+	cmd.Stdout = masked
+	cmd.Stderr = masked
 	return cmd.Run()
 }
 
@@ -97,7 +187,7 @@ func (d *DeployService) ServiceDiscovery(deployment *Deployment) (int, error) {
 	}
 
 	for k, v := range services {
-		_, err := os.Stat(fmt.Sprintf("%v/%v", deployment.ProjectPath, k))
+		_, err := os.Stat(filepath.Join(constructBuildPath(deployment), k))
 
 		if errors.Is(err, os.ErrNotExist) {
 			continue
@@ -110,113 +200,413 @@ func (d *DeployService) ServiceDiscovery(deployment *Deployment) (int, error) {
 }
 
 func (d *DeployService) FindDockerFile(deployment *Deployment) bool {
-	files := []string{"Dockerfile"}
+	_, err := os.Stat(dockerFilePath(deployment))
+	return err == nil
+}
 
-	for _, val := range files {
-		_, err := os.Stat(fmt.Sprintf("%v/%v", deployment.ProjectPath, val))
+// GetCodeBase makes a fresh shallow checkout of the requested revision, with
+// its submodules and Git LFS files, in the deployment's ProjectPath. Deploy
+// points that at a build directory of the release.
+func (d *DeployService) GetCodeBase(ctx context.Context, deployment *Deployment, checkout Checkout, out io.Writer) error {
+	err := os.MkdirAll(deployment.ProjectPath, 0777)
+	if err != nil {
+		return err
+	}
 
-		if err == nil {
-			return true
-		}
+	env, cleanup, err := d.gitEnv(deployment)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
+	git := func(args ...string) error {
+		return runGit(ctx, out, env, append([]string{"-C", deployment.ProjectPath}, args...)...)
 	}
 
-	return false
-}
+	err = git("init", "--quiet")
+	if err != nil {
+		return err
+	}
 
-func (d *DeployService) GetCodeBase(deployment *Deployment) error {
-	baseDir := "/projects"
-	gitDirPath := fmt.Sprintf("%s/.git", deployment.ProjectPath)
+	err = git("remote", "add", "origin", deployment.CloneUrl)
+	if err != nil {
+		return err
+	}
 
-	dirExists, err := exists(baseDir)
+	target, err := fetchRevision(ctx, deployment, env, checkout, out)
 	if err != nil {
 		return err
 	}
-	if !dirExists {
-		err := os.Mkdir(baseDir, 0777)
+
+	err = git("checkout", "--quiet", "--force", "--detach", target)
+	if err != nil {
+		return err
+	}
+
+	hasSubmodules, err := exists(filepath.Join(deployment.ProjectPath, ".gitmodules"))
+	if err != nil {
+		return err
+	}
+	if hasSubmodules {
+		err = git("submodule", "update", "--init", "--recursive", "--depth", "1")
 		if err != nil {
 			return err
 		}
 	}
 
-	repoExists, err := exists(gitDirPath)
+	if usesLFS(deployment.ProjectPath) {
+		return git("lfs", "pull")
+	}
+
+	return nil
+}
+
+// usesLFS reports whether the checkout tracks files with Git LFS.
+func usesLFS(dir string) bool {
+	attributes, err := os.ReadFile(filepath.Join(dir, ".gitattributes"))
+	return err == nil && strings.Contains(string(attributes), "filter=lfs")
+}
+
+func branchRef(branch string) string {
+	if strings.HasPrefix(branch, "refs/") {
+		return branch
+	}
+	return "refs/heads/" + branch
+}
+
+// fetchRevision fetches the revision of the checkout with a depth of one and
+// returns what to check out. Hosts that don't hand out commits by SHA, and
+// abbreviated SHAs, need the history fetched in full.
+func fetchRevision(ctx context.Context, deployment *Deployment, env []string, checkout Checkout, out io.Writer) (string, error) {
+	shallow := func(ref string) error {
+		return runGit(ctx, out, env, "-C", deployment.ProjectPath, "fetch", "--depth", "1", "origin", ref)
+	}
+
+	switch {
+	case checkout.Ref != "":
+		if err := ValidateRef(checkout.Ref); err != nil {
+			return "", err
+		}
+		if shallow(checkout.Ref) == nil {
+			return "FETCH_HEAD", nil
+		}
+		return resolveRef(ctx, deployment, env, checkout.Ref, out)
+	case checkout.CommitSHA != "":
+		if shallow(checkout.CommitSHA) == nil {
+			return "FETCH_HEAD", nil
+		}
+
+		fullRef := "HEAD"
+		if checkout.Branch != "" {
+			fullRef = branchRef(checkout.Branch)
+		}
+		err := runGit(ctx, out, env, "-C", deployment.ProjectPath, "fetch", "origin", fullRef)
+		if err != nil {
+			return "", err
+		}
+		return checkout.CommitSHA, nil
+	case checkout.Branch != "":
+		return "FETCH_HEAD", shallow(branchRef(checkout.Branch))
+	default:
+		return "FETCH_HEAD", shallow("HEAD")
+	}
+}
+
+// ValidateRef rejects refs that git would read as options.
+func ValidateRef(ref string) error {
+	if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	return nil
+}
+
+// resolveRef fetches all branches and tags and returns the commit a ref
+// points to. Branches are looked up first, then tags and SHAs.
+func resolveRef(ctx context.Context, deployment *Deployment, env []string, ref string, out io.Writer) (string, error) {
+	err := runGit(ctx, out, env, "-C", deployment.ProjectPath, "fetch", "--tags", "origin")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	for _, candidate := range []string{"refs/remotes/origin/" + ref, ref} {
+		sha, err := exec.CommandContext(ctx, "git", "-C", deployment.ProjectPath, "rev-parse", "--verify", "--quiet", candidate+"^{commit}").Output()
+		if err == nil {
+			return strings.TrimSpace(string(sha)), nil
+		}
 	}
 
-	if repoExists {
-		cmd := exec.Command("git", "-C", deployment.ProjectPath, "pull")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
-	} else {
-		cmd := exec.Command("git", "clone", deployment.CloneUrl, deployment.ProjectPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
+	return "", fmt.Errorf("ref %q not found", ref)
+}
+
+func runGit(ctx context.Context, out io.Writer, env []string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = env
+	cmd.Stdout = io.MultiWriter(os.Stdout, out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, out)
+	return cmd.Run()
+}
+
+func (d *DeployService) GetCommitSHA(deployment *Deployment) (string, error) {
+	out, err := exec.Command("git", "-C", deployment.ProjectPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", err
 	}
+
+	return strings.TrimSpace(string(out)), nil
 }
 
-func (d *DeployService) ContainerCreate(deployment *Deployment, dockerCli *client.Client) error {
-	ctx := context.Background()
+// containers of a deployment are found through these labels since their
+// names change with every release.
+const (
+	labelDeployment = "orchestration.deployment"
+	labelRelease    = "orchestration.release"
+	traefikNetwork  = "traefik_init_default"
+	// appDomain serves every deployment on a subdomain of its own.
+	appDomain = "dakshsangal.live"
 
-	_, err := dockerCli.ContainerInspect(ctx, deployment.ID)
-	if err == nil {
-		fmt.Println("{SERVER}: Removing existing container:", deployment.ID)
-		err = dockerCli.ContainerRemove(ctx, deployment.ID, container.RemoveOptions{Force: true})
+	containerReadyTimeout = 60 * time.Second
+)
+
+func constructContainerName(deploymentId string, releaseId string) string {
+	return fmt.Sprintf("%v-%v", deploymentId, releaseId)
+}
+
+// listDeploymentContainers returns the ids of every container belonging to the
+// deployment, including the ones created before containers were named per release.
+func (d *DeployService) listDeploymentContainers(ctx context.Context, deployment *Deployment, dockerCli *client.Client) ([]string, error) {
+	containers, err := dockerCli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%v=%v", labelDeployment, deployment.ID))),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+
+	// docker also resolves id prefixes, so make sure the name really matches.
+	legacy, err := dockerCli.ContainerInspect(ctx, deployment.ID)
+	if err == nil && legacy.Name == "/"+deployment.ID && !slices.Contains(ids, legacy.ID) {
+		ids = append(ids, legacy.ID)
+	}
+
+	return ids, nil
+}
+
+// findDeploymentContainer returns the id of the newest running container of the deployment.
+func (d *DeployService) findDeploymentContainer(ctx context.Context, deployment *Deployment, dockerCli *client.Client) (string, error) {
+	containers, err := dockerCli.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%v=%v", labelDeployment, deployment.ID))),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var newest *container.Summary
+	for i := range containers {
+		if newest == nil || containers[i].Created > newest.Created {
+			newest = &containers[i]
+		}
+	}
+
+	if newest != nil {
+		return newest.ID, nil
+	}
+
+	legacy, err := dockerCli.ContainerInspect(ctx, deployment.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if legacy.Name != "/"+deployment.ID {
+		return "", fmt.Errorf("no container found for deployment %s", deployment.ID)
+	}
+
+	return legacy.ID, nil
+}
+
+func containerAddress(ctx context.Context, containerId string, dockerCli *client.Client) (string, error) {
+	info, err := dockerCli.ContainerInspect(ctx, containerId)
+	if err != nil {
+		return "", err
+	}
+
+	if info.NetworkSettings == nil {
+		return "", errors.New("container has no network settings")
+	}
+
+	endpoint, ok := info.NetworkSettings.Networks[traefikNetwork]
+	if !ok || endpoint.IPAddress == "" {
+		return "", fmt.Errorf("container is not attached to %s", traefikNetwork)
+	}
+
+	return endpoint.IPAddress, nil
+}
+
+// waitForContainer waits for the container to be running and accepting
+// connections on the deployment port over the traefik network.
+func (d *DeployService) waitForContainer(ctx context.Context, containerId string, deployment *Deployment, dockerCli *client.Client) error {
+	deadline := time.Now().Add(containerReadyTimeout)
+
+	for time.Now().Before(deadline) {
+		info, err := dockerCli.ContainerInspect(ctx, containerId)
 		if err != nil {
-			fmt.Println("{SERVER}: Failed to remove existing container:", err.Error())
 			return err
 		}
+
+		if info.State.Restarting || info.RestartCount > 0 || info.State.Status == "exited" || info.State.Status == "dead" {
+			return fmt.Errorf("container exited with code %d", info.State.ExitCode)
+		}
+
+		if info.State.Running {
+			address, err := containerAddress(ctx, containerId, dockerCli)
+			if err == nil {
+				conn, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%v", address, deployment.Port), time.Second)
+				if err == nil {
+					conn.Close()
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	// the orchestration_default network is the default network that traefik starts on in docker.
-	// for other containers to be accessible by traefik they need to be on the same network.
-	// therefore we assign the orchestration_default network to every network so that traefik can access it.
+	return fmt.Errorf("container not ready after %v", containerReadyTimeout)
+}
 
-	// db-network will be a future plan to host a database container and making all the containers communicate to that db.
+// ContainerCreate starts the release image next to the old containers of the
+// deployment. With a health check path, the container gets a docker health
+// check and traefik only routes to it once it is healthy, otherwise once it
+// runs. The old containers are removed when the new one is healthy, or
+// accepts connections without a path. If it fails, the old ones keep serving.
+func (d *DeployService) ContainerCreate(ctx context.Context, deployment *Deployment, release *Release, dockerCli *client.Client) error {
+	oldContainers, err := d.listDeploymentContainers(ctx, deployment, dockerCli)
+	if err != nil {
+		fmt.Println("{SERVER}: Failed to list existing containers:", err.Error())
+		return err
+	}
+
+	_, err = d.startContainer(ctx, deployment, release, dockerCli)
+	if err != nil {
+		fmt.Println("{SERVER}: New container failed, keeping the old one:", err.Error())
+		return err
+	}
+
+	for _, id := range oldContainers {
+		fmt.Println("{SERVER}: Removing old container:", id)
+		d.removeContainer(id, dockerCli)
+	}
+
+	return nil
+}
 
+// traefikLabels route the deployment's subdomain to a container.
+func traefikLabels(deployment *Deployment) map[string]string {
 	labels := make(map[string]string, 0)
 
 	labels["traefik.enable"] = "true"
 	labels[fmt.Sprintf("traefik.http.routers.%v-web.rule", deployment.SubDomain)] =
-		fmt.Sprintf("Host(`%v.dakshsangal.live`)", deployment.SubDomain)
+		fmt.Sprintf("Host(`%v.%v`)", deployment.SubDomain, appDomain)
 	labels[fmt.Sprintf("traefik.http.routers.%v-web.entrypoints", deployment.SubDomain)] = "web"
+	labels[fmt.Sprintf("traefik.http.routers.%v-web.service", deployment.SubDomain)] = deployment.SubDomain
 
 	labels[fmt.Sprintf("traefik.http.routers.%v-websecure.rule", deployment.SubDomain)] =
-		fmt.Sprintf("Host(`%v.dakshsangal.live`)", deployment.SubDomain)
+		fmt.Sprintf("Host(`%v.%v`)", deployment.SubDomain, appDomain)
 	labels[fmt.Sprintf("traefik.http.routers.%v-websecure.entrypoints", deployment.SubDomain)] = "websecure"
 	labels[fmt.Sprintf("traefik.http.routers.%v-websecure.tls", deployment.SubDomain)] = "true"
 	labels[fmt.Sprintf("traefik.http.routers.%v-websecure.tls.certresolver", deployment.SubDomain)] = "letsencrypt"
-	labels["traefik.docker.network"] = "traefik_init_default"
+	labels[fmt.Sprintf("traefik.http.routers.%v-websecure.service", deployment.SubDomain)] = deployment.SubDomain
+
+	labels[fmt.Sprintf("traefik.http.services.%v.loadbalancer.server.port", deployment.SubDomain)] = fmt.Sprintf("%v", deployment.Port)
+	labels["traefik.docker.network"] = traefikNetwork
+
+	return labels
+}
+
+// startContainer runs the release image with the traefik labels of the
+// deployment and waits until it accepts connections and passed its health
+// check. A container that fails is removed again.
+func (d *DeployService) startContainer(ctx context.Context, deployment *Deployment, release *Release, dockerCli *client.Client) (string, error) {
+	// the orchestration_default network is the default network that traefik starts on in docker.
+	// for other containers to be accessible by traefik they need to be on the same network.
+	// therefore we assign the orchestration_default network to every network so that traefik can access it.
+
+	// db-network will be a future plan to host a database container and making all the containers communicate to that db.
+
+	labels := traefikLabels(deployment)
+	labels[labelDeployment] = deployment.ID
+	labels[labelRelease] = release.ID
+
+	env := make([]string, 0, len(deployment.EnvVars))
+	for _, e := range deployment.EnvVars {
+		env = append(env, fmt.Sprintf("%v=%v", e.Key, e.Value))
+	}
 
 	resp, err := dockerCli.ContainerCreate(ctx, &container.Config{
-		Image: fmt.Sprintf("%v-image", deployment.ID),
+		Image: release.ImageTag,
+		Env:   env,
 		ExposedPorts: nat.PortSet{
 			nat.Port(fmt.Sprintf("%v/tcp", deployment.Port)): struct{}{},
 		},
-		Labels: labels,
+		Labels:      labels,
+		Healthcheck: dockerHealthCheck(deployment),
 	}, &container.HostConfig{
 		RestartPolicy: container.RestartPolicy{Name: "unless-stopped"},
 	}, &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
-			"db-network":           {},
-			"traefik_init_default": {},
+			"db-network":   {},
+			traefikNetwork: {},
 		},
-	}, nil, deployment.ID)
+	}, nil, constructContainerName(deployment.ID, release.ID))
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	err = dockerCli.ContainerStart(ctx, resp.ID, container.StartOptions{})
+	if err == nil {
+		err = d.waitForContainer(ctx, resp.ID, deployment, dockerCli)
+	}
+	if err == nil && deployment.HealthCheck.Path != "" {
+		err = d.waitForHealthy(ctx, resp.ID, dockerCli)
+	}
+
 	if err != nil {
-		return err
+		d.removeContainer(resp.ID, dockerCli)
+		return "", err
 	}
 
-	return nil
+	return resp.ID, nil
+}
+
+// removeContainer force removes the container. ctx of the caller may be
+// cancelled already, the container has to go regardless.
+func (d *DeployService) removeContainer(id string, dockerCli *client.Client) {
+	err := dockerCli.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true})
+	if err != nil {
+		fmt.Println("{SERVER}: Failed to remove container:", err.Error())
+	}
+}
+
+func newDeployEvent(deployment *Deployment, step string, status EventStatus, msg string) DeployEvent {
+	return DeployEvent{
+		DeploymentID: deployment.ID,
+		SubDomain:    deployment.SubDomain,
+		Step:         step,
+		Status:       status,
+		Message:      msg,
+		Timestamp:    time.Now(),
+	}
 }
 
-func sendEvent(c chan string, msg string) {
-	c <- msg
+func sendEvent(c chan DeployEvent, event DeployEvent) {
+	c <- event
 }
@@ -0,0 +1,126 @@
+package deploy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"path"
+	"strings"
+)
+
+var (
+	ErrMissingSignature = errors.New("webhook payload is not signed")
+	ErrInvalidSignature = errors.New("webhook signature doesn't match")
+	ErrNoWebhookSecret  = errors.New("deployment has no webhook secret, rotate it first")
+)
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RotateWebhookSecret replaces the webhook secret of the deployment and returns the new one.
+func (d *DeployService) RotateWebhookSecret(deployment *Deployment) (string, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+
+	deployment.WebhookSecret = secret
+
+	err = d.repo.updateWebhookSecret(deployment)
+	if err != nil {
+		log.Printf("{SERVER}: failed to update webhook secret of %s: %v\n", deployment.ID, err)
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// VerifyWebhookSignature checks a "sha256=<hex>" signature, as sent in
+// X-Hub-Signature-256, against the HMAC of the raw body keyed with the
+// deployment's webhook secret.
+func (d *DeployService) VerifyWebhookSignature(deployment *Deployment, body []byte, signature string) error {
+	if signature == "" {
+		return d.VerifyWebhookHMAC(deployment, body, "")
+	}
+
+	sig, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	return d.VerifyWebhookHMAC(deployment, body, sig)
+}
+
+// VerifyWebhookHMAC checks a hex encoded HMAC-SHA256 of the raw body keyed
+// with the deployment's webhook secret.
+func (d *DeployService) VerifyWebhookHMAC(deployment *Deployment, body []byte, signature string) error {
+	if deployment.WebhookSecret == "" {
+		return ErrNoWebhookSecret
+	}
+
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(deployment.WebhookSecret))
+	mac.Write(body)
+
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// VerifyWebhookToken checks a plain token, for hosts that send the secret
+// itself instead of signing the body.
+func (d *DeployService) VerifyWebhookToken(deployment *Deployment, token string) error {
+	if deployment.WebhookSecret == "" {
+		return ErrNoWebhookSecret
+	}
+
+	if token == "" {
+		return ErrMissingSignature
+	}
+
+	if !hmac.Equal([]byte(token), []byte(deployment.WebhookSecret)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// BranchFromRef returns the branch of a pushed ref such as refs/heads/main.
+// Pushed tags are not branches.
+func BranchFromRef(ref string) (string, bool) {
+	return strings.CutPrefix(ref, "refs/heads/")
+}
+
+func isBranchPattern(branch string) bool {
+	return strings.ContainsAny(branch, "*?[")
+}
+
+// MatchBranch reports whether a push to the branch deploys the deployment. The
+// deployment's branch can be a pattern like release/*, and deployments without
+// a branch follow the default branch of the repository.
+func (d *DeployService) MatchBranch(deployment *Deployment, branch string, defaultBranch string) bool {
+	if deployment.Branch == "" {
+		return branch == defaultBranch
+	}
+
+	ok, err := path.Match(deployment.Branch, branch)
+	return err == nil && ok
+}
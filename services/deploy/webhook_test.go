@@ -0,0 +1,134 @@
+package deploy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	d := &DeployService{}
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	valid := sign("secret", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		want      error
+	}{
+		{"valid", "secret", "sha256=" + valid, nil},
+		{"missing", "secret", "", ErrMissingSignature},
+		{"no prefix", "secret", valid, ErrInvalidSignature},
+		{"sha1 prefix", "secret", "sha1=" + valid, ErrInvalidSignature},
+		{"empty after prefix", "secret", "sha256=", ErrMissingSignature},
+		{"not hex", "secret", "sha256=zz" + valid[2:], ErrInvalidSignature},
+		{"wrong secret", "other", "sha256=" + valid, ErrInvalidSignature},
+		{"other body", "secret", "sha256=" + sign("secret", []byte("{}")), ErrInvalidSignature},
+		{"empty secret", "", "sha256=" + sign("", body), ErrNoWebhookSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.VerifyWebhookSignature(&Deployment{WebhookSecret: tt.secret}, body, tt.signature)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookHMAC(t *testing.T) {
+	d := &DeployService{}
+	body := []byte("payload")
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		want      error
+	}{
+		{"valid", "secret", sign("secret", body), nil},
+		{"wrong secret", "secret", sign("other", body), ErrInvalidSignature},
+		{"truncated", "secret", sign("secret", body)[:32], ErrInvalidSignature},
+		{"missing", "secret", "", ErrMissingSignature},
+		{"empty secret", "", sign("", body), ErrNoWebhookSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.VerifyWebhookHMAC(&Deployment{WebhookSecret: tt.secret}, body, tt.signature)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookToken(t *testing.T) {
+	d := &DeployService{}
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		want   error
+	}{
+		{"valid", "secret", "secret", nil},
+		{"wrong token", "secret", "secreT", ErrInvalidSignature},
+		{"prefix of secret", "secret", "sec", ErrInvalidSignature},
+		{"missing", "secret", "", ErrMissingSignature},
+		{"empty secret", "", "", ErrNoWebhookSecret},
+		{"empty secret with token", "", "anything", ErrNoWebhookSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.VerifyWebhookToken(&Deployment{WebhookSecret: tt.secret}, tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchBranch(t *testing.T) {
+	d := &DeployService{}
+
+	tests := []struct {
+		name          string
+		pattern       string
+		branch        string
+		defaultBranch string
+		want          bool
+	}{
+		{"exact", "main", "main", "main", true},
+		{"other branch", "main", "dev", "main", false},
+		{"pattern", "release/*", "release/1.2", "main", true},
+		{"pattern is not recursive", "release/*", "release/1.2/hotfix", "main", false},
+		{"pattern needs the prefix", "release/*", "prerelease/1.2", "main", false},
+		{"single character", "v?", "v2", "main", true},
+		{"character class", "env-[ab]", "env-b", "main", true},
+		{"malformed pattern", "release/[", "release/[", "main", false},
+		{"no branch follows the default", "", "trunk", "trunk", true},
+		{"no branch ignores others", "", "main", "trunk", false},
+		{"no branch and no default", "", "main", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := d.MatchBranch(&Deployment{Branch: tt.pattern}, tt.branch, tt.defaultBranch)
+			if got != tt.want {
+				t.Errorf("MatchBranch(%q, %q, %q) = %v, want %v", tt.pattern, tt.branch, tt.defaultBranch, got, tt.want)
+			}
+		})
+	}
+}
@@ -113,6 +113,18 @@ func (r *UserServiceRepo) GetDeploymentsByUserID(userID string) ([]string, error
 	return deployments, nil
 }
 
+func (r *UserServiceRepo) GetUserIDByDeploymentID(deploymentID string) (string, error) {
+	query := `
+		SELECT user_id
+		FROM user_deployments
+		WHERE deployment_id = $1
+		LIMIT 1
+	`
+	var userID string
+	err := r.db.QueryRow(query, deploymentID).Scan(&userID)
+	return userID, err
+}
+
 func (r *UserServiceRepo) GetUserDeployment(userID string, deploymentID string) (*UserDeployment, error) {
 	query := `
         SELECT user_id, deployment_id
@@ -161,3 +161,15 @@ func (u *UserService) AddDeploymentToUser(ud *UserDeployment) (*UserDeployment,
 
 	return ud, nil
 }
+
+func (u *UserService) GetDeploymentOwner(deploymentId string) (string, error) {
+	userId, err := u.repo.GetUserIDByDeploymentID(deploymentId)
+
+	if err != nil {
+		fmt.Println("ERROR WHILE FETCHING THE DEPLOYMENT OWNER")
+		fmt.Println(err)
+		return "", err
+	}
+
+	return userId, nil
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE releases (
+    id VARCHAR(255) PRIMARY KEY,
+    deployment_id VARCHAR(255) NOT NULL,
+    commit_sha VARCHAR(255),
+    triggered_by VARCHAR(50) NOT NULL,
+    image_tag VARCHAR(255),
+    status VARCHAR(50) NOT NULL,
+    started_at TIMESTAMP DEFAULT now(),
+    finished_at TIMESTAMP,
+    failed_step VARCHAR(255),
+    FOREIGN KEY (deployment_id) REFERENCES deployments(id) ON DELETE CASCADE
+);
+
+CREATE INDEX releases_deployment_id_started_at_idx ON releases (deployment_id, started_at DESC);
+
+-- +goose Down
+DROP INDEX IF EXISTS releases_deployment_id_started_at_idx;
+DROP TABLE IF EXISTS releases;
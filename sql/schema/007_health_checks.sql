@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE deployments ADD COLUMN health_check_path VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE deployments ADD COLUMN health_check_status INT NOT NULL DEFAULT 200;
+ALTER TABLE deployments ADD COLUMN health_check_timeout INT NOT NULL DEFAULT 5;
+ALTER TABLE deployments ADD COLUMN health_check_retries INT NOT NULL DEFAULT 10;
+
+-- +goose Down
+ALTER TABLE deployments DROP COLUMN IF EXISTS health_check_retries;
+ALTER TABLE deployments DROP COLUMN IF EXISTS health_check_timeout;
+ALTER TABLE deployments DROP COLUMN IF EXISTS health_check_status;
+ALTER TABLE deployments DROP COLUMN IF EXISTS health_check_path;
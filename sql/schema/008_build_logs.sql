@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE releases ADD COLUMN build_log TEXT;
+
+-- +goose Down
+ALTER TABLE releases DROP COLUMN IF EXISTS build_log;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE releases ADD COLUMN failure_reason TEXT;
+
+-- +goose Down
+ALTER TABLE releases DROP COLUMN IF EXISTS failure_reason;
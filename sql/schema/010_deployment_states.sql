@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE deployment_states (
+    deployment_id VARCHAR(255) PRIMARY KEY,
+    status VARCHAR(50) NOT NULL,
+    release_id VARCHAR(255),
+    message TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now(),
+    FOREIGN KEY (deployment_id) REFERENCES deployments(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS deployment_states;
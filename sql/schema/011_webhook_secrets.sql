@@ -0,0 +1,6 @@
+-- +goose Up
+-- deployments created before this have to rotate their secret before webhooks are accepted again.
+ALTER TABLE deployments ADD COLUMN webhook_secret VARCHAR(255) NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE deployments DROP COLUMN IF EXISTS webhook_secret;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- a repository can have one deployment per branch, e.g. staging and production.
+ALTER TABLE deployments DROP CONSTRAINT IF EXISTS deployments_clone_url_key;
+CREATE INDEX deployments_clone_url_idx ON deployments (clone_url);
+
+-- +goose Down
+DROP INDEX IF EXISTS deployments_clone_url_idx;
+ALTER TABLE deployments ADD CONSTRAINT deployments_clone_url_key UNIQUE (clone_url);
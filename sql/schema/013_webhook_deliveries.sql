@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE webhook_deliveries (
+    id VARCHAR(255) PRIMARY KEY,
+    deployment_id VARCHAR(255),
+    provider VARCHAR(50) NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    body BYTEA NOT NULL,
+    signature_valid BOOLEAN NOT NULL DEFAULT FALSE,
+    status VARCHAR(50) NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    release_id VARCHAR(255),
+    replay_of VARCHAR(255),
+    received_at TIMESTAMP NOT NULL DEFAULT now(),
+    FOREIGN KEY (deployment_id) REFERENCES deployments(id) ON DELETE CASCADE,
+    FOREIGN KEY (release_id) REFERENCES releases(id) ON DELETE SET NULL
+);
+
+CREATE INDEX webhook_deliveries_deployment_idx ON webhook_deliveries (deployment_id, received_at DESC);
+
+-- +goose Down
+DROP TABLE IF EXISTS webhook_deliveries;
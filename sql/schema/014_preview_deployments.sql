@@ -0,0 +1,11 @@
+-- +goose Up
+-- preview deployments of pull requests point at the deployment of the branch
+-- the pull request targets.
+ALTER TABLE deployments ADD COLUMN parent_id VARCHAR(255) REFERENCES deployments(id) ON DELETE CASCADE;
+ALTER TABLE deployments ADD COLUMN pr_number INT NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX deployments_preview_idx ON deployments (parent_id, pr_number) WHERE parent_id IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS deployments_preview_idx;
+ALTER TABLE deployments DROP COLUMN IF EXISTS pr_number;
+ALTER TABLE deployments DROP COLUMN IF EXISTS parent_id;
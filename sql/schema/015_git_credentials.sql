@@ -0,0 +1,13 @@
+-- +goose Up
+-- secret holds the encrypted ssh private key or https token.
+CREATE TABLE git_credentials (
+    deployment_id VARCHAR(255) PRIMARY KEY,
+    kind VARCHAR(50) NOT NULL,
+    public_key TEXT NOT NULL DEFAULT '',
+    secret BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    FOREIGN KEY (deployment_id) REFERENCES deployments(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS git_credentials;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- root_dir is the directory of the repository a deployment builds, dockerfile_path is relative to it.
+ALTER TABLE deployments ADD COLUMN root_dir VARCHAR(1000) NOT NULL DEFAULT '';
+ALTER TABLE deployments ADD COLUMN dockerfile_path VARCHAR(1000) NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE deployments DROP COLUMN IF EXISTS dockerfile_path;
+ALTER TABLE deployments DROP COLUMN IF EXISTS root_dir;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- env vars are passed to the container at runtime, only build_time ones are baked into the image.
+ALTER TABLE env_vars ADD COLUMN build_time BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE env_vars DROP COLUMN IF EXISTS build_time;
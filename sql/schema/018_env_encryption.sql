@@ -0,0 +1,13 @@
+-- +goose Up
+-- sealed_value holds the value encrypted with data_key, which is wrapped with
+-- the master key key_id. Rows with an empty key_id keep their value in plain.
+ALTER TABLE env_vars ADD COLUMN secret BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE env_vars ADD COLUMN sealed_value BYTEA;
+ALTER TABLE env_vars ADD COLUMN data_key BYTEA;
+ALTER TABLE env_vars ADD COLUMN key_id VARCHAR(64) NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE env_vars DROP COLUMN IF EXISTS key_id;
+ALTER TABLE env_vars DROP COLUMN IF EXISTS data_key;
+ALTER TABLE env_vars DROP COLUMN IF EXISTS sealed_value;
+ALTER TABLE env_vars DROP COLUMN IF EXISTS secret;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- values were capped at 255 characters, their size is checked by the server now.
+ALTER TABLE env_vars ALTER COLUMN value TYPE TEXT;
+
+-- +goose Down
+ALTER TABLE env_vars ALTER COLUMN value TYPE VARCHAR(255);
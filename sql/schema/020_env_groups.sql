@@ -0,0 +1,39 @@
+-- +goose Up
+-- env groups hold vars shared by several deployments of a user. position
+-- orders the groups of a deployment, later groups override earlier ones and
+-- the deployment's own vars override all of them.
+CREATE TABLE env_groups (
+    id VARCHAR(255) PRIMARY KEY,
+    owner_id VARCHAR NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    UNIQUE (owner_id, name),
+    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE env_group_vars (
+    group_id VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    value TEXT,
+    build_time BOOLEAN NOT NULL DEFAULT FALSE,
+    secret BOOLEAN NOT NULL DEFAULT FALSE,
+    sealed_value BYTEA,
+    data_key BYTEA,
+    key_id VARCHAR(64) NOT NULL DEFAULT '',
+    PRIMARY KEY (group_id, key),
+    FOREIGN KEY (group_id) REFERENCES env_groups(id) ON DELETE CASCADE
+);
+
+CREATE TABLE deployment_env_groups (
+    deployment_id VARCHAR(255) NOT NULL,
+    group_id VARCHAR(255) NOT NULL,
+    position INT NOT NULL,
+    PRIMARY KEY (deployment_id, group_id),
+    FOREIGN KEY (deployment_id) REFERENCES deployments(id) ON DELETE CASCADE,
+    FOREIGN KEY (group_id) REFERENCES env_groups(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS deployment_env_groups;
+DROP TABLE IF EXISTS env_group_vars;
+DROP TABLE IF EXISTS env_groups;
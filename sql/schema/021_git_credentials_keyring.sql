@@ -0,0 +1,10 @@
+-- +goose Up
+-- git credentials are encrypted like env values: secret is sealed with
+-- data_key, which is wrapped with the ENV_KEYS key key_id. Rows with an empty
+-- key_id were sealed with the former CREDENTIALS_KEY and are rewrapped on startup.
+ALTER TABLE git_credentials ADD COLUMN data_key BYTEA;
+ALTER TABLE git_credentials ADD COLUMN key_id VARCHAR(64) NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE git_credentials DROP COLUMN IF EXISTS key_id;
+ALTER TABLE git_credentials DROP COLUMN IF EXISTS data_key;